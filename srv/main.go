@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 )
@@ -15,10 +20,45 @@ const (
 )
 
 var (
-	peerId  = flag.String("peerId", "", "host:raftPort:httpPort")
-	dataDir = flag.String("data", "", "Data storage directory")
-	join    = flag.String("join", "", "Comma-separated list of host:raftPort:httpPort cluster nodes")
-	log     = hclog.New(&hclog.LoggerOptions{Name: "vephar"})
+	peerId      = flag.String("peerId", "", "host:raftPort:httpPort")
+	dataDir     = flag.String("data", "", "Data storage directory")
+	join        = flag.String("join", "", "Comma-separated list of host:raftPort:httpPort cluster nodes")
+	replica     = flag.Bool("nonVoter", false, "Skip bootstrapping and wait to be added to the cluster as a non-voter")
+	leave       = flag.Bool("leaveOnTerm", false, "Remove this node from the cluster configuration on SIGINT/SIGTERM")
+	autopilot   = flag.Bool("autopilot", false, "Remove dead servers and promote new voters once they are stable")
+	deadAfter   = flag.Duration("deadServerThreshold", 5*time.Minute, "Autopilot: unreachable time after which a server is removed")
+	stableAfter = flag.Duration("serverStabilization", 10*time.Second, "Autopilot: healthy time before a new server is promoted to voter")
+	minQuorum   = flag.Int("minQuorum", 3, "Autopilot: never remove dead voters below this count")
+	tlsCert     = flag.String("tlsCert", "", "PEM certificate of this node, valid for the host part of its peer ID")
+	tlsKey      = flag.String("tlsKey", "", "PEM private key for -tlsCert")
+	tlsCa       = flag.String("tlsCa", "", "PEM cluster CA. Enables mutual TLS on the raft transport")
+	httpsCert   = flag.String("httpsCert", "", "PEM certificate for the HTTP API and UI. Enables HTTPS")
+	httpsKey    = flag.String("httpsKey", "", "PEM private key for -httpsCert")
+	httpsVerify = flag.Bool("httpsVerifyClients", false, "Require HTTPS clients to present a certificate signed by -tlsCa")
+	aclMaster   = flag.String("aclMasterToken", "", "Token with every right, shared by all nodes. Enables ACL enforcement")
+	sessionTtl  = flag.Duration("sessionTtl", 12*time.Hour, "Lifetime of UI login sessions")
+	oidcIssuer  = flag.String("oidcIssuer", "", "OpenID Connect issuer URL. Enables UI login through OIDC")
+	oidcClient  = flag.String("oidcClientId", "", "OIDC client ID")
+	oidcSecret  = flag.String("oidcClientSecret", "", "OIDC client secret")
+	oidcRedir   = flag.String("oidcRedirectUrl", "", "OIDC redirect URL, i.e. this node's "+RAuthOidcBack)
+	readyMaxLag = flag.Uint64("readyMaxLag", 100, "Maximum applied index lag behind the commit index for a node to be ready")
+	drain       = flag.Duration("drainTimeout", 30*time.Second, "Maximum time to wait for in-flight HTTP requests on shutdown")
+	fwdTimeout  = flag.Duration("forwardTimeout", 15*time.Second, "Maximum time to forward a request to the leader, retries included")
+	redirect    = flag.Bool("redirectToLeader", false, "Answer writes sent to a follower with a 307 redirect to the leader instead of proxying them")
+	rpcForward  = flag.Bool("rpcForwarding", true, "Submit writes received by followers to the leader over the raft port, instead of proxying HTTP (requires -tlsCa)")
+	writeTime   = flag.Duration("writeTimeout", DefaultWriteTimeout, "Time to wait for a write to be applied, unless the request sets a timeout")
+	maxWrite    = flag.Duration("maxWriteTimeout", time.Minute, "Maximum write timeout a request may set")
+	maxInflight = flag.Int("maxInflightWrites", 4096, "Maximum client writes the leader waits on at once. 0 disables the limit")
+	maxLag      = flag.Uint64("maxApplyLag", 0, "Refuse writes while the leader has more entries appended than applied. 0 disables the check")
+	maxLatency  = flag.Duration("maxApplyLatency", 0, "Refuse writes while the average time writes take to apply is higher. 0 disables the check")
+	clientRate  = flag.Float64("clientWriteRate", 0, "Writes per second allowed to each client by a node. 0 disables rate limiting")
+	clientBurst = flag.Int("clientWriteBurst", 0, "Writes a client may send at once, over -clientWriteRate. Defaults to the rate")
+	batchSize   = flag.Int("batchSize", 1, "Maximum number of concurrent writes the leader commits as one log entry. 1 disables batching")
+	batchWindow = flag.Duration("batchWindow", 2*time.Millisecond, "Maximum time a batch waits for more writes")
+	accessPath  = flag.String("accessLog", "", "Access log file, or - for stdout. Disabled when empty")
+	otlpUrl     = flag.String("otlpEndpoint", "", "OTLP/HTTP collector URL, e.g. http://localhost:4318. Enables tracing")
+	traceRatio  = flag.Float64("traceSampleRatio", 1, "Fraction of new traces to record")
+	log         = hclog.New(&hclog.LoggerOptions{Name: "vephar"})
 )
 
 func main() {
@@ -35,19 +75,83 @@ func main() {
 		log.Error("error: wrong number of arguments")
 		flag.Usage()
 	} else {
-		srv := NewServer(*dataDir, *peerId, strings.Split(*join, ","))
+		srv := NewServer(*dataDir, *peerId, strings.Split(*join, ","), *replica)
+		srv.aclMaster = *aclMaster
+		srv.useRpc = *rpcForward
+		srv.writeWait, srv.writeMax = *writeTime, *maxWrite
+		if srv.writeMax < srv.writeWait {
+			srv.writeMax = srv.writeWait
+		}
+		if *maxInflight > 0 || *maxLag > 0 || *maxLatency > 0 {
+			srv.admission = NewAdmission(srv, *maxInflight, *maxLag, *maxLatency)
+		}
+		if *batchSize > 1 {
+			srv.batcher = NewBatcher(srv, *batchWindow, *batchSize)
+		}
+		if sink, err := InitMetrics(); err != nil {
+			log.Error("failed to initialize metrics", "error", err)
+		} else {
+			srv.metrics = sink
+		}
+		if *autopilot {
+			srv.autopilot = NewAutopilot(srv, *deadAfter, *stableAfter, *minQuorum)
+		}
+		if len(*tlsCa) > 0 {
+			tlsStore, err := NewTlsStore(*tlsCert, *tlsKey, *tlsCa)
+			if err != nil {
+				log.Error("failed to load TLS certificates", "error", err)
+				os.Exit(1)
+			}
+			srv.tls = tlsStore
+		}
+		if len(*httpsCert) > 0 {
+			httpsStore, err := NewTlsStore(*httpsCert, *httpsKey, *tlsCa)
+			if err != nil {
+				log.Error("failed to load HTTPS certificates", "error", err)
+				os.Exit(1)
+			}
+			srv.https = httpsStore
+		}
+		var oidc *Oidc
+		if len(*oidcIssuer) > 0 {
+			oidc = NewOidc(*oidcIssuer, *oidcClient, *oidcSecret, *oidcRedir)
+		}
+		srv.sessions = NewSessions(srv, *sessionTtl, srv.https != nil, oidc)
+		if len(*otlpUrl) > 0 {
+			if t, err := NewTracer(*otlpUrl, *peerId, *traceRatio); err != nil {
+				log.Error("failed to start tracing", "url", *otlpUrl, "error", err)
+			} else {
+				t.Start()
+			}
+		}
 		if err := srv.Start(); err != nil {
 			log.Error("failed to start server", "peerId", *peerId, "error", err)
 		}
 
-		hdl := NewWebHandler(srv)
-		http.HandleFunc(RKvList, hdl.KeysRequest)
-		http.HandleFunc(RKvGet, hdl.GetRequest)
-		http.HandleFunc(RKvSet, hdl.SetRequest)
-		http.HandleFunc(RKvDel, hdl.DeleteRequest)
-		http.HandleFunc(RRfJoin, hdl.RaftJoinRequest)
-		http.HandleFunc(RRfLeave, hdl.RaftLeaveRequest)
-		http.HandleFunc(RRfStat, hdl.RaftStatusRequest)
+		var accessLog hclog.Logger
+		if len(*accessPath) > 0 {
+			al, err := NewAccessLog(*accessPath)
+			if err != nil {
+				log.Error("failed to open access log", "path", *accessPath, "error", err)
+				os.Exit(1)
+			}
+			accessLog = al
+		}
+
+		hdl := NewWebHandler(srv, *readyMaxLag, *fwdTimeout)
+		hdl.redirectWrites = *redirect
+		if *clientRate > 0 {
+			hdl.limiter = NewRateLimiter(*clientRate, *clientBurst)
+		}
+		var handler http.Handler = http.DefaultServeMux
+		for _, r := range hdl.Routes() {
+			route := Access(r.Path, accessLog, Traced(r.Path, Instrument(r.Path, Handled(r.Handler))))
+			if strings.HasSuffix(r.Path, "/") {
+				handler = ServePrefix(r.Path, route, handler)
+			} else {
+				http.HandleFunc(r.Path, route)
+			}
+		}
 		http.HandleFunc(RUi, ResourceHandler)
 		http.HandleFunc(RIndexJs, ResourceHandler)
 		http.HandleFunc(RIndexCss, ResourceHandler)
@@ -56,7 +160,41 @@ func main() {
 
 		peerRaft, httpPort := parsePeer(*peerId)
 		peerHttp := fmt.Sprintf("%s:%s", strings.Split(peerRaft, ":")[0], httpPort)
+		web := &http.Server{Addr: peerHttp, Handler: handler}
+		go func() {
+			var err error
+			if srv.https != nil {
+				clientAuth := tls.VerifyClientCertIfGiven
+				if *httpsVerify {
+					clientAuth = tls.RequireAndVerifyClientCert
+				}
+				web.TLSConfig = srv.https.HttpsConfig(clientAuth)
+				err = web.ListenAndServeTLS("", "")
+			} else {
+				err = web.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				log.Error("", "status", err)
+			}
+		}()
 		log.Info("Peer started", "peerId", *peerId)
-		log.Error("", "status", http.ListenAndServe(peerHttp, nil))
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		log.Info("Shutting down", "peerId", *peerId, "signal", sig)
+		srv.BeginShutdown()
+
+		ctx, cancel := context.WithTimeout(context.Background(), *drain)
+		defer cancel()
+		if err := web.Shutdown(ctx); err != nil {
+			log.Warn("HTTP drain incomplete", "error", err)
+		}
+		if err := srv.Stop(*leave); err != nil {
+			log.Error("failed to stop server", "peerId", *peerId, "error", err)
+		}
+		if tracer != nil {
+			tracer.Stop()
+		}
 	}
 }
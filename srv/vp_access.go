@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	HRequestId       = "X-Request-ID"
+	MaxRequestIdSize = 128
+)
+
+type accessKey struct{}
+
+// VpAccess follows a request through the handlers, for the access log.
+type VpAccess struct {
+	RequestId   string
+	Route       string // template of the route, rather than the path, for metrics and spans
+	ForwardedTo string
+	Replayed    bool // answered with the outcome of an earlier write with the same idempotency key
+
+	handled *http.Request // as passed to the route's handler, see Handled
+}
+
+/*
+	NewAccessLog opens the access log: one JSON object per request, written to
+	stdout for "-" or appended to the file at path otherwise.
+*/
+func NewAccessLog(path string) (hclog.Logger, error) {
+	out := os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	return hclog.New(&hclog.LoggerOptions{Name: "access", Output: out, JSONFormat: true}), nil
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+// validRequestId accepts client request IDs of printable ASCII characters only.
+func validRequestId(id string) bool {
+	if len(id) == 0 || len(id) > MaxRequestIdSize {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func accessOf(req *http.Request) *VpAccess {
+	return accessOfContext(req.Context())
+}
+
+func accessOfContext(ctx context.Context) *VpAccess {
+	if a, ok := ctx.Value(accessKey{}).(*VpAccess); ok {
+		return a
+	}
+	return &VpAccess{}
+}
+
+// requestIdOf returns the ID given to a request by Access, if any.
+func requestIdOf(req *http.Request) string {
+	return accessOf(req).RequestId
+}
+
+// routeOf returns the route of a request, as registered with Access.
+func routeOf(req *http.Request) string {
+	return accessOf(req).Route
+}
+
+func formKeyOf(req *http.Request) string {
+	if key, err := v1KeyOf(req); err == nil {
+		return key
+	}
+	form := req.Form
+	if form == nil {
+		form = req.URL.Query()
+	}
+	if key := form.Get(PKey); len(key) > 0 {
+		return key
+	}
+	return form.Get(PPrefix)
+}
+
+/* ==================================================================================
+                            Access logging
+================================================================================== */
+
+/*
+	Access gives each request an ID, the client's X-Request-ID when valid or a random one,
+	and returns it in the response headers. When accessLog is set, each request is logged
+	once answered, with the node it was forwarded to, if any.
+*/
+func Access(route string, accessLog hclog.Logger, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		a := &VpAccess{RequestId: req.Header.Get(HRequestId), Route: route}
+		if !validRequestId(a.RequestId) {
+			a.RequestId, _ = randomHex(16)
+		}
+		w.Header().Set(HRequestId, a.RequestId)
+		req = req.WithContext(context.WithValue(req.Context(), accessKey{}, a))
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, req)
+		if accessLog == nil {
+			return
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		handled := req
+		if a.handled != nil {
+			handled = a.handled
+		}
+		accessLog.Info("request",
+			"request_id", a.RequestId, "method", req.Method, "route", route, "key", formKeyOf(handled),
+			"status", sw.status, "latency_ms", float64(time.Since(start).Microseconds())/1000,
+			"bytes", sw.bytes, "remote", req.RemoteAddr, "forwarded_to", a.ForwardedTo,
+			"replayed", a.Replayed)
+	}
+}
+
+/*
+	Handled records the request passed to the handler of a route, whose form was parsed by the
+	handler: wrappers between Access and the handler, such as Traced, pass it copies of the request
+	made by WithContext, so the key of a form body is only found in the handled request.
+*/
+func Handled(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		accessOf(req).handled = req
+		next(w, req)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+type copyKey struct{}
+
+// TestAccessLogKey checks that the key of a request is logged when it is sent in a form body, which
+// the handler parses on a copy of the request.
+func TestAccessLogKey(t *testing.T) {
+	var out bytes.Buffer
+	accessLog := hclog.New(&hclog.LoggerOptions{Output: &out, JSONFormat: true})
+	handler := func(w http.ResponseWriter, req *http.Request) { req.ParseForm() }
+	copied := func(next http.HandlerFunc) http.HandlerFunc { // as Traced does
+		return func(w http.ResponseWriter, req *http.Request) {
+			next(w, req.WithContext(context.WithValue(req.Context(), copyKey{}, true)))
+		}
+	}
+	for _, c := range []struct {
+		req *http.Request
+		key string
+	}{
+		{httptest.NewRequest(Post, RKvSet, strings.NewReader("key=a/b&value=v")), "a/b"},
+		{httptest.NewRequest(Get, RKvGet+"?key=c", nil), "c"},
+		{httptest.NewRequest(Get, RV1Kv+"d%2Fe", nil), "d/e"},
+	} {
+		if c.req.Method == Post {
+			c.req.Header.Set(HContentType, "application/x-www-form-urlencoded")
+		}
+		out.Reset()
+		w := httptest.NewRecorder()
+		Access(RKvSet, accessLog, copied(Handled(handler)))(w, c.req)
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["key"] != c.key {
+			t.Errorf("%s %s: logged key %v, want %s", c.req.Method, c.req.URL, entry["key"], c.key)
+		}
+		if len(w.Header().Get(HRequestId)) == 0 || entry["request_id"] != w.Header().Get(HRequestId) {
+			t.Errorf("request ID %v, answered %s", entry["request_id"], w.Header().Get(HRequestId))
+		}
+	}
+}
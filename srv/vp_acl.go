@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	HToken         = "X-Vephar-Token"
+	HAuthorization = "Authorization"
+	VBearer        = "Bearer "
+	AclPolicyKind  = "policy/"
+	AclTokenKind   = "token/"
+	AclAnonymous   = "anonymous" // policy applied to requests without a token
+	AclMaster      = "master"
+	PName          = "name"
+	PAccessor      = "accessor"
+)
+
+const (
+	RAclPolList = "/acl/policy/list"
+	RAclPolSet  = "/acl/policy/set"
+	RAclPolDel  = "/acl/policy/del"
+	RAclTokList = "/acl/token/list"
+	RAclTokNew  = "/acl/token/create"
+	RAclTokDel  = "/acl/token/del"
+)
+
+type AclRight int
+
+const (
+	AclDeny AclRight = iota
+	AclRead
+	AclWrite
+	AclAdmin
+)
+
+var (
+	aclRights        = []string{"deny", "read", "write", "admin"}
+	ErrAclNoToken    = errors.New("ACL token not found")
+	ErrAclDenied     = errors.New("permission denied")
+	ErrAclBadRight   = errors.New("access must be one of deny, read, write, admin")
+	ErrAclNoPolicies = errors.New("token must have at least one policy")
+)
+
+type VpAclRule struct {
+	Prefix string
+	Access string
+}
+
+// VpPolicy grants rights on key prefixes and on cluster operations. For keys, the
+// longest matching prefix of a policy applies. For the cluster, read covers status
+// queries, write covers leadership and suffrage changes, and admin covers membership
+// and ACL management.
+type VpPolicy struct {
+	Name    string
+	Keys    []VpAclRule
+	Cluster string
+}
+
+type VpToken struct {
+	Accessor    string
+	SecretHash  string
+	Description string
+	Policies    []string
+}
+
+// VpTokenSecret is only returned once, when a token is created.
+type VpTokenSecret struct {
+	VpToken
+	Secret string
+}
+
+// VpPrincipal is the identity a request is authorized as.
+type VpPrincipal struct {
+	Name     string
+	Policies []*VpPolicy
+	master   bool
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+func parseRight(access string) (AclRight, error) {
+	for i, r := range aclRights {
+		if r == access {
+			return AclRight(i), nil
+		}
+	}
+	return AclDeny, ErrAclBadRight
+}
+
+func (p *VpPolicy) validate() error {
+	if len(p.Name) == 0 {
+		return errors.New("policy name is required")
+	}
+	for _, rule := range p.Keys {
+		if _, err := parseRight(rule.Access); err != nil {
+			return err
+		}
+	}
+	if len(p.Cluster) > 0 {
+		if _, err := parseRight(p.Cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *VpPolicy) keyRight(key string) AclRight {
+	match, right := -1, AclDeny
+	for _, rule := range p.Keys {
+		if strings.HasPrefix(key, rule.Prefix) && len(rule.Prefix) > match {
+			match = len(rule.Prefix)
+			right, _ = parseRight(rule.Access)
+		}
+	}
+	return right
+}
+
+func (p *VpPolicy) clusterRight() AclRight {
+	right, _ := parseRight(p.Cluster)
+	return right
+}
+
+func (p *VpPrincipal) KeyAllowed(key string, right AclRight) bool {
+	if p.master {
+		return true
+	}
+	for _, pol := range p.Policies {
+		if pol.keyRight(key) >= right {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *VpPrincipal) ClusterAllowed(right AclRight) bool {
+	if p.master {
+		return true
+	}
+	for _, pol := range p.Policies {
+		if pol.clusterRight() >= right {
+			return true
+		}
+	}
+	return false
+}
+
+func secretHashOf(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// tokenOf reads the ACL token of a request, if any.
+func tokenOf(req *http.Request) string {
+	if tk := req.Header.Get(HToken); len(tk) > 0 {
+		return tk
+	}
+	if auth := req.Header.Get(HAuthorization); strings.HasPrefix(auth, VBearer) {
+		return strings.TrimPrefix(auth, VBearer)
+	}
+	return ""
+}
+
+/* ==================================================================================
+                            ACL storage
+================================================================================== */
+
+func (s *Server) AclEnabled() bool {
+	return len(s.aclMaster) > 0
+}
+
+func (s *Server) AclPolicy(name string) (*VpPolicy, error) {
+	raw, err := s.store.GetAcl([]byte(AclPolicyKind + name))
+	if err != nil {
+		return nil, err
+	}
+	pol := &VpPolicy{}
+	if err := json.Unmarshal(raw, pol); err != nil {
+		return nil, err
+	}
+	return pol, nil
+}
+
+func (s *Server) AclPolicies() ([]VpPolicy, error) {
+	raws, err := s.store.AclValuesOf([]byte(AclPolicyKind))
+	if err != nil {
+		return nil, err
+	}
+	policies := make([]VpPolicy, len(raws))
+	for i, raw := range raws {
+		if err := json.Unmarshal(raw, &policies[i]); err != nil {
+			return nil, err
+		}
+	}
+	return policies, nil
+}
+
+func (s *Server) AclTokens() ([]VpToken, error) {
+	raws, err := s.store.AclValuesOf([]byte(AclTokenKind))
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]VpToken, len(raws))
+	for i, raw := range raws {
+		if err := json.Unmarshal(raw, &tokens[i]); err != nil {
+			return nil, err
+		}
+		tokens[i].SecretHash = ""
+	}
+	return tokens, nil
+}
+
+func (s *Server) RaftAclSetPolicy(pol *VpPolicy, o *VpOrigin) error {
+	if err := pol.validate(); err != nil {
+		return err
+	}
+	buff, err := json.Marshal(pol)
+	if err != nil {
+		return err
+	}
+	return s.raftApply(&VpLogCmd{Op: CMDACLSET, Key: AclPolicyKind + pol.Name, Value: buff, Origin: o})
+}
+
+func (s *Server) RaftAclDeletePolicy(name string, o *VpOrigin) error {
+	return s.raftApply(&VpLogCmd{Op: CMDACLDEL, Key: AclPolicyKind + name, Origin: o})
+}
+
+// RaftAclCreateToken stores a new token for the given policies and returns its secret,
+// which is only kept as a hash.
+func (s *Server) RaftAclCreateToken(description string, policies []string, o *VpOrigin) (*VpTokenSecret, error) {
+	if len(policies) == 0 {
+		return nil, ErrAclNoPolicies
+	}
+	secret, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	accessor, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	tk := VpToken{Accessor: accessor, SecretHash: secretHashOf(secret), Description: description, Policies: policies}
+	buff, err := json.Marshal(&tk)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.raftApply(&VpLogCmd{Op: CMDACLSET, Key: AclTokenKind + tk.SecretHash, Value: buff, Origin: o}); err != nil {
+		return nil, err
+	}
+	tk.SecretHash = ""
+	return &VpTokenSecret{VpToken: tk, Secret: secret}, nil
+}
+
+func (s *Server) RaftAclDeleteToken(accessor string, o *VpOrigin) error {
+	raws, err := s.store.AclValuesOf([]byte(AclTokenKind))
+	if err != nil {
+		return err
+	}
+	for _, raw := range raws {
+		tk := VpToken{}
+		if err := json.Unmarshal(raw, &tk); err != nil {
+			return err
+		}
+		if tk.Accessor == accessor {
+			return s.raftApply(&VpLogCmd{Op: CMDACLDEL, Key: AclTokenKind + tk.SecretHash, Origin: o})
+		}
+	}
+	return fmt.Errorf("token not found: [%s]", accessor)
+}
+
+// PrincipalOf resolves a token secret. Requests without a token get the policy
+// named "anonymous", if there is one.
+func (s *Server) PrincipalOf(secret string) (*VpPrincipal, error) {
+	if len(secret) == 0 {
+		p := &VpPrincipal{Name: AclAnonymous}
+		if pol, err := s.AclPolicy(AclAnonymous); err == nil {
+			p.Policies = append(p.Policies, pol)
+		}
+		return p, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.aclMaster)) == 1 {
+		return &VpPrincipal{Name: AclMaster, master: true}, nil
+	}
+	raw, err := s.store.GetAcl([]byte(AclTokenKind + secretHashOf(secret)))
+	if err == ErrKeyNotFound {
+		return nil, ErrAclNoToken
+	} else if err != nil {
+		return nil, err
+	}
+	tk := VpToken{}
+	if err := json.Unmarshal(raw, &tk); err != nil {
+		return nil, err
+	}
+	return s.principalFor(tk.Accessor, tk.Policies), nil
+}
+
+// PrincipalOfRequest authorizes a request by its token, or by its UI session cookie.
+func (s *Server) PrincipalOfRequest(req *http.Request) (*VpPrincipal, error) {
+	if tk := tokenOf(req); len(tk) > 0 {
+		return s.PrincipalOf(tk)
+	}
+	if c, err := req.Cookie(CSession); err == nil {
+		return s.sessions.PrincipalOf(c.Value)
+	}
+	return s.PrincipalOf("")
+}
+
+// PrincipalOfCredentials authorizes the token, or else the session cookie, forwarded with a write.
+func (s *Server) PrincipalOfCredentials(token, session string) (*VpPrincipal, error) {
+	if len(token) == 0 && len(session) > 0 {
+		return s.sessions.PrincipalOf(session)
+	}
+	return s.PrincipalOf(token)
+}
+
+func (s *Server) principalFor(name string, policies []string) *VpPrincipal {
+	p := &VpPrincipal{Name: name}
+	for _, polName := range policies {
+		if pol, err := s.AclPolicy(polName); err == nil {
+			p.Policies = append(p.Policies, pol)
+		} else {
+			log.Warn("ACL policy not found", "principal", name, "policy", polName)
+		}
+	}
+	return p
+}
+
+/* ==================================================================================
+                            Request authorization
+================================================================================== */
+
+// AclCheck decides whether a principal may perform a request.
+type AclCheck func(p *VpPrincipal, req *http.Request) bool
+
+func keyAccess(param string, right AclRight) AclCheck {
+	return func(p *VpPrincipal, req *http.Request) bool {
+		req.ParseForm() // same key source as the handlers, multipart bodies are left unread
+		return p.KeyAllowed(req.Form.Get(param), right)
+	}
+}
+
+func clusterAccess(right AclRight) AclCheck {
+	return func(p *VpPrincipal, req *http.Request) bool {
+		return p.ClusterAllowed(right)
+	}
+}
+
+// bodyAccess lets any authenticated principal through, for handlers which check the keys
+// named in the request body themselves, with keysAllowed.
+func bodyAccess(p *VpPrincipal, req *http.Request) bool {
+	return true
+}
+
+// keysAllowed checks that the principal of a request holds right on every key.
+func (h *WebHandler) keysAllowed(req *http.Request, keys []string, right AclRight) error {
+	if !h.s.AclEnabled() {
+		return nil
+	}
+	p, err := h.s.PrincipalOfRequest(req)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if !p.KeyAllowed(key, right) {
+			log.Warn("ACL denied", "principal", p.Name, "method", req.Method, "uri", req.RequestURI, "key", key)
+			return ErrAclDenied
+		}
+	}
+	return nil
+}
+
+/*
+	keysVisible returns the filter of the keys the principal of req may list: read access to the
+	listed prefix doesn't imply access to every key under it, e.g. below a prefix denied by a longer
+	rule. It is nil when ACLs are disabled.
+*/
+func (h *WebHandler) keysVisible(req *http.Request) (func(key string) bool, error) {
+	if !h.s.AclEnabled() {
+		return nil, nil
+	}
+	p, err := h.s.PrincipalOfRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return func(key string) bool { return p.KeyAllowed(key, AclRead) }, nil
+}
+
+// Guard enforces check on the principal of each request before calling next.
+func (h *WebHandler) Guard(check AclCheck, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !h.s.AclEnabled() {
+			next(w, req)
+			return
+		}
+		p, err := h.s.PrincipalOfRequest(req)
+		if err == ErrAclNoToken || err == ErrAclNoSession {
+			onError(w, err, http.StatusUnauthorized)
+		} else if err != nil {
+			onError(w, err, http.StatusInternalServerError)
+		} else if !check(p, req) {
+			log.Warn("ACL denied", "principal", p.Name, "method", req.Method, "uri", req.RequestURI)
+			onError(w, ErrAclDenied, http.StatusForbidden)
+		} else {
+			next(w, req)
+		}
+	}
+}
+
+/* ==================================================================================
+                            Request methods
+================================================================================== */
+
+func (h *WebHandler) AclPolicyListRequest(w http.ResponseWriter, req *http.Request) {
+	if policies, err := h.s.AclPolicies(); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: policies}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) AclPolicySetRequest(w http.ResponseWriter, req *http.Request) {
+	if h.s.raft.State() != raft.Leader {
+		h.forwardToLeader(w, req)
+		return
+	}
+	pol := VpPolicy{}
+	if body, err := bodyOf(w, req); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else if err := json.Unmarshal(body, &pol); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else if err := h.s.RaftAclSetPolicy(&pol, h.originOf(req)); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else {
+		onSuccess(w, &VpResponse{Data: pol.Name}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) AclPolicyDeleteRequest(w http.ResponseWriter, req *http.Request) {
+	if h.s.raft.State() != raft.Leader {
+		h.forwardToLeader(w, req)
+		return
+	}
+	name := req.FormValue(PName)
+	if err := h.s.RaftAclDeletePolicy(name, h.originOf(req)); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: name}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) AclTokenListRequest(w http.ResponseWriter, req *http.Request) {
+	if tokens, err := h.s.AclTokens(); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: tokens}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) AclTokenCreateRequest(w http.ResponseWriter, req *http.Request) {
+	if h.s.raft.State() != raft.Leader {
+		h.forwardToLeader(w, req)
+		return
+	}
+	in := VpToken{}
+	if body, err := bodyOf(w, req); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else if err := json.Unmarshal(body, &in); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else if tk, err := h.s.RaftAclCreateToken(in.Description, in.Policies, h.originOf(req)); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else {
+		onSuccess(w, &VpResponse{Data: tk}, http.StatusCreated)
+	}
+}
+
+func (h *WebHandler) AclTokenDeleteRequest(w http.ResponseWriter, req *http.Request) {
+	if h.s.raft.State() != raft.Leader {
+		h.forwardToLeader(w, req)
+		return
+	}
+	accessor := req.FormValue(PAccessor)
+	if err := h.s.RaftAclDeleteToken(accessor, h.originOf(req)); err != nil {
+		onError(w, err, http.StatusNotFound)
+	} else {
+		onSuccess(w, &VpResponse{Data: accessor}, http.StatusOK)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testMaster   = "master-secret"
+	testAppToken = "app-secret"
+	testOpsToken = "ops-secret"
+)
+
+// newAclServer serves the policies app, ops and anonymous, and a token for each of app and ops.
+func newAclServer(t *testing.T) *Server {
+	s := &Server{store: newTestStore(t), aclMaster: testMaster}
+	s.sessions = NewSessions(s, time.Hour, false, nil)
+	index := uint64(0)
+	set := func(key string, v interface{}) {
+		buff, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index++
+		if res := applyCmd(t, s.store, index, &VpLogCmd{Op: CMDACLSET, Key: key, Value: buff}); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+	for _, pol := range []VpPolicy{
+		{Name: "app", Keys: []VpAclRule{{"app/", "write"}, {"app/secret/", "deny"}, {"shared/", "read"}}},
+		{Name: "ops", Keys: []VpAclRule{{"", "read"}}, Cluster: "write"},
+		{Name: AclAnonymous, Keys: []VpAclRule{{"public/", "read"}}},
+	} {
+		set(AclPolicyKind+pol.Name, &pol)
+	}
+	set(AclTokenKind+secretHashOf(testAppToken), &VpToken{Accessor: "app", Policies: []string{"app", "missing"}})
+	set(AclTokenKind+secretHashOf(testOpsToken), &VpToken{Accessor: "ops", Policies: []string{"ops"}})
+	return s
+}
+
+func TestPolicyKeyRight(t *testing.T) {
+	pol := VpPolicy{Keys: []VpAclRule{{"", "read"}, {"a/", "write"}, {"a/b/", "deny"}, {"a/b/c", "admin"}}}
+	for key, want := range map[string]AclRight{
+		"x":      AclRead,
+		"a/":     AclWrite,
+		"a/x":    AclWrite,
+		"a/b/x":  AclDeny,
+		"a/b/cd": AclAdmin,
+		"a":      AclRead,
+	} {
+		if got := pol.keyRight(key); got != want {
+			t.Errorf("keyRight(%q) = %s, want %s", key, aclRights[got], aclRights[want])
+		}
+	}
+	if right := (&VpPolicy{}).keyRight("a"); right != AclDeny {
+		t.Errorf("keys are denied without rule, got %s", aclRights[right])
+	}
+	if err := (&VpPolicy{Name: "p", Keys: []VpAclRule{{"a", "all"}}}).validate(); err != ErrAclBadRight {
+		t.Errorf("invalid access accepted: %v", err)
+	}
+}
+
+func TestPrincipalOf(t *testing.T) {
+	s := newAclServer(t)
+	for _, c := range []struct {
+		token, key string
+		right      AclRight
+		cluster    AclRight
+		allowed    bool
+	}{
+		{testMaster, "any", AclAdmin, AclAdmin, true},
+		{testAppToken, "app/x", AclWrite, AclDeny, true},
+		{testAppToken, "app/secret/x", AclRead, AclDeny, false},
+		{testAppToken, "shared/x", AclRead, AclDeny, true},
+		{testAppToken, "shared/x", AclWrite, AclDeny, false},
+		{testAppToken, "other", AclRead, AclDeny, false},
+		{testOpsToken, "app/secret/x", AclRead, AclWrite, true},
+		{testOpsToken, "app/x", AclWrite, AclWrite, false},
+		{"", "public/x", AclRead, AclDeny, true},
+		{"", "public/x", AclWrite, AclDeny, false},
+		{"", "app/x", AclRead, AclDeny, false},
+	} {
+		p, err := s.PrincipalOf(c.token)
+		if err != nil {
+			t.Fatalf("%q: %v", c.token, err)
+		}
+		if got := p.KeyAllowed(c.key, c.right); got != c.allowed {
+			t.Errorf("%s: %s on %s allowed %v", p.Name, aclRights[c.right], c.key, got)
+		}
+		if !p.ClusterAllowed(c.cluster) || (c.cluster < AclAdmin && p.ClusterAllowed(c.cluster+1)) {
+			t.Errorf("%s: cluster right is not %s", p.Name, aclRights[c.cluster])
+		}
+	}
+	if _, err := s.PrincipalOf("unknown"); err != ErrAclNoToken {
+		t.Errorf("unknown token: %v", err)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	s := newAclServer(t)
+	h := NewWebHandler(s, 0, 0)
+	ok := func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(http.StatusOK) }
+	set := h.Guard(keyAccess(PKey, AclWrite), ok)
+	status := h.Guard(clusterAccess(AclRead), ok)
+	for _, c := range []struct {
+		handler http.HandlerFunc
+		uri     string
+		token   string
+		want    int
+	}{
+		{set, RKvSet + "?key=app/x", testAppToken, http.StatusOK},
+		{set, RKvSet + "?key=app/secret/x", testAppToken, http.StatusForbidden},
+		{set, RKvSet + "?key=app/x", testOpsToken, http.StatusForbidden},
+		{set, RKvSet + "?key=app/x", "", http.StatusForbidden},
+		{set, RKvSet + "?key=app/x", "unknown", http.StatusUnauthorized},
+		{set, RKvSet + "?key=app/x", testMaster, http.StatusOK},
+		{status, RRfStat, testOpsToken, http.StatusOK},
+		{status, RRfStat, testAppToken, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(Post, c.uri, nil)
+		if len(c.token) > 0 {
+			req.Header.Set(HToken, c.token)
+		}
+		w := httptest.NewRecorder()
+		c.handler(w, req)
+		if w.Code != c.want {
+			t.Errorf("%s with %q: %d, want %d", c.uri, c.token, w.Code, c.want)
+		}
+	}
+	// bearer tokens are accepted too, forged session cookies are not
+	req := httptest.NewRequest(Post, RKvSet+"?key=app/x", nil)
+	req.Header.Set(HAuthorization, VBearer+testAppToken)
+	w := httptest.NewRecorder()
+	if set(w, req); w.Code != http.StatusOK {
+		t.Errorf("bearer token: %d", w.Code)
+	}
+	req = httptest.NewRequest(Post, RKvSet+"?key=app/x", nil)
+	req.AddCookie(&http.Cookie{Name: CSession, Value: "forged"})
+	w = httptest.NewRecorder()
+	if set(w, req); w.Code != http.StatusUnauthorized {
+		t.Errorf("forged session: %d", w.Code)
+	}
+	s.aclMaster = ""
+	w = httptest.NewRecorder()
+	if set(w, httptest.NewRequest(Post, RKvSet+"?key=x", nil)); w.Code != http.StatusOK {
+		t.Errorf("ACLs disabled: %d", w.Code)
+	}
+}
+
+func TestKeysAllowed(t *testing.T) {
+	h := NewWebHandler(newAclServer(t), 0, 0)
+	for _, c := range []struct {
+		keys  []string
+		right AclRight
+		want  error
+	}{
+		{[]string{"app/a", "app/b"}, AclWrite, nil},
+		{[]string{"app/a", "shared/b"}, AclRead, nil},
+		{[]string{"app/a", "shared/b"}, AclWrite, ErrAclDenied},
+		{[]string{"app/a", "app/secret/b", "app/c"}, AclRead, ErrAclDenied},
+		{[]string{"other"}, AclRead, ErrAclDenied},
+	} {
+		req := httptest.NewRequest(Post, RKvBatchSet, nil)
+		req.Header.Set(HToken, testAppToken)
+		if err := h.keysAllowed(req, c.keys, c.right); err != c.want {
+			t.Errorf("%v, %s: %v, want %v", c.keys, aclRights[c.right], err, c.want)
+		}
+	}
+}
+
+// TestBulkGetDenied checks that a bulk read is refused as a whole when any of its keys is denied.
+func TestBulkGetDenied(t *testing.T) {
+	s := newAclServer(t)
+	applyCmd(t, s.store, 100, &VpLogCmd{Op: CMDSET, Key: "app/a", Value: []byte("a")})
+	applyCmd(t, s.store, 101, &VpLogCmd{Op: CMDSET, Key: "app/secret/b", Value: []byte("b")})
+	h := NewWebHandler(s, 0, 0)
+	handler := h.Guard(bodyAccess, h.BulkGetRequest)
+	for _, c := range []struct {
+		method, query, body string
+		token               string
+		want                int
+	}{
+		{Get, "?key=app/a&key=shared/c", "", testAppToken, http.StatusOK},
+		{Get, "?key=app/a&key=app/secret/b", "", testAppToken, http.StatusForbidden},
+		{Post, "", `[{"Key":"app/a"},{"Key":"app/secret/b"}]`, testAppToken, http.StatusForbidden},
+		{Post, "", `{"Key":"app/a"}` + "\n" + `{"Key":"other"}`, testAppToken, http.StatusForbidden},
+		{Post, "", `[{"Key":"app/a"},{"Key":"app/secret/b"}]`, testOpsToken, http.StatusOK},
+		{Get, "?key=app/a", "", "", http.StatusForbidden},
+		{Get, "?key=app/a", "", "unknown", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(c.method, RKvBatchGet+c.query, strings.NewReader(c.body))
+		if len(c.token) > 0 {
+			req.Header.Set(HToken, c.token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != c.want {
+			t.Errorf("%s %s%s with %q: %d, want %d", c.method, c.query, c.body, c.token, w.Code, c.want)
+		}
+		if c.want != http.StatusOK && strings.Contains(w.Body.String(), `"Value"`) {
+			t.Errorf("denied bulk read returned values: %s", w.Body.String())
+		}
+	}
+}
+
+// TestClusterChangesAdmin checks that changes which may cost the cluster its quorum require admin access.
+func TestClusterChangesAdmin(t *testing.T) {
+	s := newAclServer(t)
+	h := NewWebHandler(s, 0, 0)
+	routes := make(map[string]http.HandlerFunc)
+	for _, r := range h.Routes() {
+		routes[r.Path] = r.Handler
+	}
+	for _, path := range []string{RRfXfer, RRfProm, RRfDem, RRfJoin, RRfLeave} {
+		req := httptest.NewRequest(Post, path+"?peerId=a:9090:8080", nil)
+		req.Header.Set(HToken, testOpsToken) // cluster write
+		w := httptest.NewRecorder()
+		if routes[path](w, req); w.Code != http.StatusForbidden {
+			t.Errorf("%s with cluster write access: %d, want 403", path, w.Code)
+		}
+	}
+}
+
+// TestKeysListed checks that listing a readable prefix leaves out the keys denied below it.
+func TestKeysListed(t *testing.T) {
+	s := newAclServer(t)
+	for i, key := range []string{"app/a", "app/secret/b", "app/z", "other"} {
+		applyCmd(t, s.store, uint64(100+i), &VpLogCmd{Op: CMDSET, Key: key, Value: []byte("v")})
+	}
+	h := NewWebHandler(s, 0, 0)
+	list := h.Guard(keyAccess(PPrefix, AclRead), h.KeysRequest)
+	for _, c := range []struct {
+		query, token string
+		want         []string
+	}{
+		{"?prefix=app/&pageSize=10", testAppToken, []string{"app/a", "app/z"}},
+		{"?prefix=app/&pageSize=1", testAppToken, []string{"app/a"}},
+		{"?prefix=app/&pageSize=10&offset=app/b", testAppToken, []string{"app/z"}},
+		{"?prefix=app/&pageSize=10", testOpsToken, []string{"app/a", "app/secret/b", "app/z"}},
+		{"?prefix=&pageSize=10", testMaster, []string{"app/a", "app/secret/b", "app/z", "other"}},
+	} {
+		req := httptest.NewRequest(Get, RKvList+c.query, nil)
+		req.Header.Set(HToken, c.token)
+		w := httptest.NewRecorder()
+		list(w, req)
+		res := struct{ Data VpKeyPage }{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", c.query, w.Code, w.Body.String())
+		}
+		if strings.Join(res.Data.Keys, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%s with %s: %v, want %v", c.query, c.token, res.Data.Keys, c.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	OverloadRetryAfter = time.Second
+	LatencyDecay       = 0.1 // weight of each write in the moving average of the apply latency
+	RateIdleExpiry     = 10 * time.Minute
+)
+
+var (
+	ErrOverloaded  = errors.New("the leader is overloaded, retry later")
+	ErrRateLimited = errors.New("write rate limit exceeded, retry later")
+)
+
+/*
+	Admission protects the leader from more writes than it can apply: it bounds the number of
+	client writes waiting to be applied, and refuses new ones while the entries appended to the
+	log but not applied yet, or the moving average of the time writes take to apply, exceed
+	their thresholds. A zero threshold disables the corresponding check.
+*/
+type Admission struct {
+	s          *Server
+	inflight   chan struct{}
+	writes     int32 // in flight, counted whether or not their number is bounded
+	maxLag     uint64
+	maxLatency time.Duration
+	mu         sync.Mutex
+	latency    float64 // nanoseconds
+}
+
+// RateLimiter allows each client rate writes per second, in bursts of up to burst writes.
+type RateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewAdmission(s *Server, maxInflight int, maxLag uint64, maxLatency time.Duration) *Admission {
+	a := &Admission{s: s, maxLag: maxLag, maxLatency: maxLatency}
+	if maxInflight > 0 {
+		a.inflight = make(chan struct{}, maxInflight)
+	}
+	return a
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket), pruned: time.Now()}
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+// onWriteError answers a failed write, asking clients to retry later when the leader is overloaded.
+func onWriteError(w http.ResponseWriter, err error) {
+	status := writeStatusOf(err)
+	if status == http.StatusTooManyRequests {
+		w.Header().Set(HRetryAfter, strconv.Itoa(int(OverloadRetryAfter.Seconds())))
+	}
+	onError(w, err, status)
+}
+
+// clientOf identifies the client of a request for rate limiting: its principal, or its address.
+func (h *WebHandler) clientOf(req *http.Request) string {
+	o := h.originOf(req)
+	if o.Principal != AclAnonymous {
+		return o.Principal
+	}
+	if host, _, err := net.SplitHostPort(o.Client); err == nil {
+		return host
+	}
+	return o.Client
+}
+
+/* ==================================================================================
+                            Admission control
+================================================================================== */
+
+// Acquire admits a write, which must then be released with its outcome.
+func (a *Admission) Acquire() (func(), error) {
+	if a.maxLag > 0 {
+		if last, applied := a.s.raft.LastIndex(), a.s.raft.AppliedIndex(); last > applied && last-applied > a.maxLag {
+			return nil, a.reject("apply_lag")
+		}
+	}
+	if a.maxLatency > 0 && atomic.LoadInt32(&a.writes) > 0 { // without writes in flight, the average can't recover
+		a.mu.Lock()
+		latency := time.Duration(a.latency)
+		a.mu.Unlock()
+		if latency > a.maxLatency {
+			return nil, a.reject("latency")
+		}
+	}
+	if a.inflight != nil {
+		select {
+		case a.inflight <- struct{}{}:
+		default:
+			return nil, a.reject("inflight")
+		}
+	}
+	metrics.SetGauge([]string{"write", "inflight"}, float32(atomic.AddInt32(&a.writes, 1)))
+	start := time.Now()
+	return func() {
+		a.mu.Lock()
+		a.latency += LatencyDecay * (float64(time.Since(start)) - a.latency)
+		a.mu.Unlock()
+		atomic.AddInt32(&a.writes, -1)
+		if a.inflight != nil {
+			<-a.inflight
+		}
+	}, nil
+}
+
+func (a *Admission) reject(reason string) error {
+	metrics.IncrCounterWithLabels([]string{"write", "rejected"}, 1, []metrics.Label{{Name: "reason", Value: reason}})
+	return ErrOverloaded
+}
+
+/* ==================================================================================
+                            Rate limiting
+================================================================================== */
+
+// Allow takes n tokens from the bucket of client, at most burst.
+func (l *RateLimiter) Allow(client string, n int) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.pruned) > RateIdleExpiry {
+		for c, b := range l.buckets {
+			if now.Sub(b.last) > RateIdleExpiry {
+				delete(l.buckets, c)
+			}
+		}
+		l.pruned = now
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	need := math.Min(float64(n), l.burst)
+	if b.tokens < need {
+		return false
+	}
+	b.tokens -= need
+	return true
+}
+
+// admit applies the per-client rate limit to a request of n writes, and answers it when exceeded.
+func (h *WebHandler) admit(w http.ResponseWriter, req *http.Request, n int) bool {
+	if h.limiter == nil || h.limiter.Allow(h.clientOf(req), n) {
+		return true
+	}
+	metrics.IncrCounterWithLabels([]string{"write", "rejected"}, 1, []metrics.Label{{Name: "reason", Value: "rate"}})
+	onWriteError(w, ErrRateLimited)
+	return false
+}
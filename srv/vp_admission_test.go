@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := NewRateLimiter(1, 2)
+	for i, want := range []bool{true, true, false} {
+		if got := l.Allow("a", 1); got != want {
+			t.Errorf("write %d: allowed %v, want %v", i, got, want)
+		}
+	}
+	if !l.Allow("b", 1) {
+		t.Error("clients must have their own bucket")
+	}
+	l.buckets["a"].last = time.Now().Add(-time.Second)
+	if !l.Allow("a", 1) {
+		t.Error("bucket not refilled at the rate")
+	}
+	if l.Allow("a", 1) {
+		t.Error("bucket refilled faster than the rate")
+	}
+	l.buckets["a"].last = time.Now().Add(-time.Hour)
+	if !l.Allow("a", 10) {
+		t.Error("requests of more writes than the burst must be allowed by a full bucket")
+	}
+	if l.Allow("a", 1) {
+		t.Error("a full bucket must hold at most burst tokens")
+	}
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	l := NewRateLimiter(2.5, 0)
+	if l.burst != 3 {
+		t.Errorf("burst %v, want the rate rounded up", l.burst)
+	}
+}
+
+func TestAdmitRateLimited(t *testing.T) {
+	h := NewWebHandler(&Server{}, 0, 0)
+	h.limiter = NewRateLimiter(1, 1)
+	req := httptest.NewRequest(Post, RKvSet+"?key=a", nil)
+	if w := httptest.NewRecorder(); !h.admit(w, req, 1) {
+		t.Fatalf("first write refused: %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	if h.admit(w, req, 1) {
+		t.Fatal("second write admitted")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want 429", w.Code)
+	}
+	if w.Header().Get(HRetryAfter) != "1" {
+		t.Errorf("Retry-After: %q", w.Header().Get(HRetryAfter))
+	}
+}
+
+// TestAdmissionLatency checks the latency gate without a bound on the writes in flight.
+func TestAdmissionLatency(t *testing.T) {
+	a := NewAdmission(&Server{}, 0, 0, time.Millisecond)
+	release, err := a.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	release()
+	if a.latency < float64(time.Millisecond) {
+		t.Fatalf("latency %v not above the threshold", time.Duration(a.latency))
+	}
+	release, err = a.Acquire()
+	if err != nil {
+		t.Fatal("writes must be admitted while none is in flight, so that the average recovers")
+	}
+	if _, err := a.Acquire(); err != ErrOverloaded {
+		t.Errorf("got %v while a slow write is in flight, want ErrOverloaded", err)
+	}
+	release()
+	if a.writes != 0 {
+		t.Errorf("%d writes in flight after release", a.writes)
+	}
+}
+
+func TestAdmissionInflight(t *testing.T) {
+	a := NewAdmission(&Server{}, 1, 0, 0)
+	release, err := a.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Acquire(); err != ErrOverloaded {
+		t.Errorf("got %v beyond the bound, want ErrOverloaded", err)
+	}
+	release()
+	if _, err := a.Acquire(); err != nil {
+		t.Errorf("write refused once released: %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	HOriginNode     = "X-Vephar-Node"
+	HForwardedFor   = "X-Forwarded-For"
+	HHopSignature   = "X-Vephar-Signature"
+	HopMaxSkew      = time.Minute // age after which a signed hop is refused, as a replay
+	VNdJson         = "application/x-ndjson"
+	PFrom           = "from"
+	PTo             = "to"
+	PPrincipal      = "principal"
+	PLimit          = "limit"
+	PFormat         = "format"
+	AuditSystem     = "system:"           // principal prefix of changes made by the nodes themselves
+	AuditMaxEntries = 1000                // default limit of JSON responses, NDJSON exports are unbounded
+	AuditRetention  = 90 * 24 * time.Hour // must be the same on every node, since Apply depends on it
+	AuditPruneMax   = 128                 // expired entries removed per applied entry
+)
+
+const (
+	RAudit = "/audit"
+)
+
+// VpOrigin describes who asked for a change: the authenticated principal, the node
+// which received the client request and the address of the client.
+type VpOrigin struct {
+	Principal string
+	Node      string
+	Client    string
+	RequestId string
+}
+
+// VpAuditEntry is the audit record of one committed log command. Values are not
+// recorded, only their size.
+type VpAuditEntry struct {
+	Index     uint64
+	Time      time.Time // when the leader appended the entry
+	Op        string
+	Key       string
+	Size      int
+	Detail    string
+	Principal string
+	Node      string
+	Client    string
+	RequestId string
+}
+
+type VpAuditQuery struct {
+	From      time.Time
+	To        time.Time
+	Prefix    string
+	Principal string
+	Limit     int
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+func auditKeyOf(idx uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016x", dbAudPrefix, idx)) // fixed width, so entries iterate in log order
+}
+
+// batchAuditKeyOf sorts the entries of a batch after auditKeyOf(idx), and before idx+1.
+func batchAuditKeyOf(idx uint64, pos int) []byte {
+	return []byte(fmt.Sprintf("%s%016x/%08x", dbAudPrefix, idx, pos))
+}
+
+func (q *VpAuditQuery) matches(e *VpAuditEntry) bool {
+	return (q.From.IsZero() || !e.Time.Before(q.From)) &&
+		(q.To.IsZero() || e.Time.Before(q.To)) &&
+		strings.HasPrefix(e.Key, q.Prefix) &&
+		(len(q.Principal) == 0 || e.Principal == q.Principal)
+}
+
+func parseAuditTime(v string) (time.Time, error) {
+	if len(v) == 0 {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func auditEntryOf(rLog *raft.Log, cmd *VpLogCmd) *VpAuditEntry {
+	e := &VpAuditEntry{Index: rLog.Index, Time: rLog.AppendedAt.UTC(), Op: cmd.Op, Key: cmd.Key, Size: len(cmd.Value)}
+	if cmd.Op == CMDMEMBER || cmd.Op == CMDSTAGE {
+		e.Size, e.Detail = 0, string(cmd.Value)
+	}
+	if cmd.Origin != nil {
+		e.Principal, e.Node, e.Client = cmd.Origin.Principal, cmd.Origin.Node, cmd.Origin.Client
+		e.RequestId = cmd.Origin.RequestId
+	}
+	return e
+}
+
+/* ==================================================================================
+                            Origin of changes
+================================================================================== */
+
+// systemOrigin attributes a change to this node itself, e.g. autopilot or shutdown.
+func (s *Server) systemOrigin(name string) *VpOrigin {
+	return &VpOrigin{Principal: AuditSystem + name, Node: s.peerId}
+}
+
+// isPeerId reports whether peerId is a server of the cluster configuration.
+func (s *Server) isPeerId(peerId string) bool {
+	configFuture := s.raft.GetConfiguration()
+	if configFuture.Error() != nil {
+		return false
+	}
+	for _, srv := range configFuture.Configuration().Servers {
+		if string(srv.ID) == peerId {
+			return true
+		}
+	}
+	return false
+}
+
+// hopMacOf signs the origin headers of a forwarded request with a key derived from the master token.
+func (s *Server) hopMacOf(node, forwardedFor, requestId string, at int64) string {
+	key := sha256.Sum256([]byte("vephar-hop:" + s.aclMaster))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(strings.Join([]string{node, forwardedFor, requestId, strconv.FormatInt(at, 10)}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signHop authenticates the origin headers of a request this node forwards, when nodes share a key.
+func (s *Server) signHop(fwd *http.Request) {
+	if !s.AclEnabled() {
+		return
+	}
+	at := time.Now().Unix()
+	mac := s.hopMacOf(s.peerId, fwd.Header.Get(HForwardedFor), fwd.Header.Get(HRequestId), at)
+	fwd.Header.Set(HHopSignature, fmt.Sprintf("%d:%s", at, mac))
+}
+
+func (s *Server) hopSigned(req *http.Request, node string) bool {
+	parts := strings.SplitN(req.Header.Get(HHopSignature), ":", 2)
+	if !s.AclEnabled() || len(parts) != 2 {
+		return false
+	}
+	at, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Since(time.Unix(at, 0)) > HopMaxSkew || time.Until(time.Unix(at, 0)) > HopMaxSkew {
+		return false
+	}
+	mac := s.hopMacOf(node, req.Header.Get(HForwardedFor), req.Header.Get(HRequestId), at)
+	return hmac.Equal([]byte(mac), []byte(parts[1]))
+}
+
+// hopCertified reports whether req came with a client certificate of the cluster CA valid for the host of node.
+func (s *Server) hopCertified(req *http.Request, node string) bool {
+	if s.https == nil || req.TLS == nil {
+		return false
+	}
+	if _, pool := s.https.current(); pool == nil { // system roots don't authenticate nodes
+		return false
+	}
+	return s.https.verifyChain(req.TLS.PeerCertificates, []string{strings.Split(node, ":")[0]}) == nil
+}
+
+/*
+	forwardedBy returns the node which forwarded req, only when that node is a server of the cluster
+	and authenticated: by its HTTPS client certificate, signed by -tlsCa, or by the signature of the
+	origin headers with the key nodes derive from the master token. Forwarded requests are not
+	authenticated without either, and their origin headers are ignored.
+*/
+func (h *WebHandler) forwardedBy(req *http.Request) string {
+	node := req.Header.Get(HOriginNode)
+	if len(node) == 0 || !h.s.isPeerId(node) {
+		return ""
+	}
+	if h.s.hopCertified(req, node) || h.s.hopSigned(req, node) {
+		return node
+	}
+	return ""
+}
+
+/*
+	originOf identifies the principal, node and client of a request. Requests forwarded
+	by another cluster node carry the node which received them and the client address
+	in headers; these headers are only trusted when forwardedBy authenticates the node.
+*/
+func (h *WebHandler) originOf(req *http.Request) *VpOrigin {
+	o := &VpOrigin{Principal: AclAnonymous, Node: h.s.peerId, Client: req.RemoteAddr, RequestId: requestIdOf(req)}
+	if h.s.AclEnabled() {
+		if p, err := h.s.PrincipalOfRequest(req); err == nil {
+			o.Principal = p.Name
+		}
+	}
+	if node := h.forwardedBy(req); len(node) > 0 {
+		o.Node = node
+		if fwd := strings.Split(req.Header.Get(HForwardedFor), ","); len(strings.TrimSpace(fwd[len(fwd)-1])) > 0 {
+			o.Client = strings.TrimSpace(fwd[len(fwd)-1])
+		}
+	}
+	return o
+}
+
+/*
+	auditMember records a committed membership change, which raft applies outside of the FSM. The
+	record is a log entry of its own, following the configuration change: a leader which fails or
+	loses its leadership in between leaves the change unaudited, though raft keeps it in its log.
+*/
+func (s *Server) auditMember(peerId, action string, index uint64, o *VpOrigin) {
+	s.auditMemberAs(CMDMEMBER, peerId, action, index, o)
+}
+
+// auditMemberAs records a membership change with op, CMDSTAGE to stage the peer for promotion.
+func (s *Server) auditMemberAs(op, peerId, action string, index uint64, o *VpOrigin) {
+	detail := action
+	if index > 0 { // 0 before the change
+		detail = fmt.Sprintf("%s, configuration index %d", action, index)
+	}
+	if err := s.raftApply(&VpLogCmd{Op: op, Key: peerId, Value: []byte(detail), Origin: o}); err != nil {
+		log.Error("failed to audit membership change", "peerId", peerId, "action", action, "error", err)
+	}
+}
+
+/* ==================================================================================
+                            Audit storage
+================================================================================== */
+
+// AuditOf calls fn with each audit entry matching q, in log order.
+func (b *BadgerStore) AuditOf(q *VpAuditQuery, fn func(e *VpAuditEntry) error) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		n := 0
+		for it.Seek(dbAudPrefix); it.ValidForPrefix(dbAudPrefix); it.Next() {
+			e := VpAuditEntry{}
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &e) }); err != nil {
+				return err
+			}
+			if !q.matches(&e) {
+				continue
+			}
+			if err := fn(&e); err != nil {
+				return err
+			}
+			if n++; q.Limit > 0 && n >= q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+/*
+	pruneAudit removes up to AuditPruneMax entries older than AuditRetention at now. Entries are
+	in log order, so that the oldest ones come first and pruning stops at the first one to keep.
+*/
+func pruneAudit(txn *badger.Txn, now time.Time) error {
+	until := now.Add(-AuditRetention)
+	expired := make([][]byte, 0)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	for it.Seek(dbAudPrefix); it.ValidForPrefix(dbAudPrefix) && len(expired) < AuditPruneMax; it.Next() {
+		e := VpAuditEntry{}
+		if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &e) }); err != nil {
+			it.Close()
+			return err
+		}
+		if !e.Time.Before(until) {
+			break
+		}
+		expired = append(expired, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+	for _, key := range expired {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* ==================================================================================
+                            Request methods
+================================================================================== */
+
+// AuditRequest queries the local copy of the audit log, as JSON or as NDJSON.
+func (h *WebHandler) AuditRequest(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	q := VpAuditQuery{Prefix: req.Form.Get(PPrefix), Principal: req.Form.Get(PPrincipal)}
+	ndjson := req.Form.Get(PFormat) == "ndjson" || strings.Contains(req.Header.Get("Accept"), VNdJson)
+	var err error
+	if q.From, err = parseAuditTime(req.Form.Get(PFrom)); err != nil {
+		onError(w, err, http.StatusBadRequest)
+		return
+	}
+	if q.To, err = parseAuditTime(req.Form.Get(PTo)); err != nil {
+		onError(w, err, http.StatusBadRequest)
+		return
+	}
+	if limit := req.Form.Get(PLimit); len(limit) > 0 {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			onError(w, err, http.StatusBadRequest)
+			return
+		}
+	} else if !ndjson {
+		q.Limit = AuditMaxEntries
+	}
+	if ndjson {
+		w.Header().Set(HContentType, VNdJson)
+		enc := json.NewEncoder(w) // encodes one entry per line
+		if err := h.s.store.AuditOf(&q, func(e *VpAuditEntry) error { return enc.Encode(e) }); err != nil {
+			log.Error("audit export failed", "error", err)
+		}
+		return
+	}
+	entries := make([]VpAuditEntry, 0)
+	if err := h.s.store.AuditOf(&q, func(e *VpAuditEntry) error {
+		entries = append(entries, *e)
+		return nil
+	}); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: entries}, http.StatusOK)
+	}
+}
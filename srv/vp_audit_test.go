@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func auditOf(t *testing.T, store *BadgerStore) []VpAuditEntry {
+	entries := make([]VpAuditEntry, 0)
+	if err := store.AuditOf(&VpAuditQuery{}, func(e *VpAuditEntry) error {
+		entries = append(entries, *e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// TestAuditRetention checks that applied entries prune the expired audit entries, a bounded number at a time.
+func TestAuditRetention(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+	old := make([]VpLogCmd, AuditPruneMax+1)
+	for i := range old {
+		old[i] = VpLogCmd{Op: CMDSET, Key: fmt.Sprint("old", i), Value: []byte("v")}
+	}
+	applyCmdAt(t, store, 1, &VpLogCmd{Op: CMDBATCH, Batch: old}, now.Add(-AuditRetention-time.Hour))
+	applyCmdAt(t, store, 2, &VpLogCmd{Op: CMDSET, Key: "recent", Value: []byte("v")}, now.Add(-AuditRetention+time.Hour))
+	if n := len(auditOf(t, store)); n != len(old)+1 {
+		t.Fatalf("%d entries, none expired yet", n)
+	}
+
+	applyCmdAt(t, store, 3, &VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("v")}, now)
+	if n := len(auditOf(t, store)); n != 3 {
+		t.Errorf("%d entries, want %d pruned", n, AuditPruneMax)
+	}
+	applyCmdAt(t, store, 4, &VpLogCmd{Op: CMDSET, Key: "b", Value: []byte("v")}, now)
+	entries := auditOf(t, store)
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	if strings.Join(keys, " ") != "recent a b" {
+		t.Errorf("entries %v, want the ones within the retention", keys)
+	}
+	if v := valueOf(t, store, "old0"); v != "v" {
+		t.Errorf("data pruned with its audit entry: %q", v)
+	}
+}
+
+// TestAuditLeaderLeave checks that a leader removing itself records its leave before the change.
+func TestAuditLeaderLeave(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	leader, follower := nodes[0], nodes[1]
+	if err := leader.RaftLeave(leader.peerId, &VpOrigin{Principal: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the audit entry on the follower", func() bool { return len(auditOf(t, follower.store)) > 0 })
+	entries := auditOf(t, follower.store)
+	if len(entries) != 1 {
+		t.Fatalf("%d audit entries, want the leave", len(entries))
+	}
+	if e := entries[0]; e.Op != CMDMEMBER || e.Key != leader.peerId || e.Principal != "ops" || !strings.HasPrefix(e.Detail, "leave") {
+		t.Errorf("entry %+v", e)
+	}
+	if leader.isPeerId(leader.peerId) {
+		t.Error("leader still in the configuration")
+	}
+}
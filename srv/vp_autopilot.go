@@ -0,0 +1,240 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	AutopilotInterval     = 10 * time.Second
+	AutopilotMaxTrailLogs = 250 // how far behind the leader a staged server may be to get promoted
+)
+
+type VpServerHealth struct {
+	ID          string
+	Suffrage    string
+	Healthy     bool
+	LastContact time.Time
+	StagedSince time.Time
+}
+
+/*
+	Autopilot runs on every node but only acts while the node is the leader. It follows
+	heartbeat observations to find unreachable servers, removes them from the configuration
+	once they have been gone for longer than deadAfter (never shrinking the voters below
+	minQuorum), and promotes non-voters once they have been healthy for stableAfter and have
+	caught up with the leader's log. Only the servers which asked to join as voters are staged
+	for promotion, by RaftJoin in the replicated state, so that a new leader picks them up; the
+	staging is cleared by any later membership change, so that replicas joining as non-voters
+	and demoted servers are never promoted.
+*/
+type Autopilot struct {
+	s           *Server
+	deadAfter   time.Duration
+	stableAfter time.Duration
+	minQuorum   int
+
+	mu      sync.Mutex
+	failing map[raft.ServerID]time.Time // peer -> last successful contact
+	healthy map[raft.ServerID]time.Time // non-voter -> time since it has been healthy
+	obsCh   chan raft.Observation
+	stopCh  chan struct{}
+}
+
+func NewAutopilot(s *Server, deadAfter, stableAfter time.Duration, minQuorum int) *Autopilot {
+	return &Autopilot{
+		s: s, deadAfter: deadAfter, stableAfter: stableAfter, minQuorum: minQuorum,
+		failing: make(map[raft.ServerID]time.Time),
+		healthy: make(map[raft.ServerID]time.Time),
+	}
+}
+
+func (a *Autopilot) Start() {
+	a.obsCh = make(chan raft.Observation, 64)
+	a.stopCh = make(chan struct{})
+	observer := raft.NewObserver(a.obsCh, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation, raft.PeerObservation, raft.LeaderObservation:
+			return true
+		}
+		return false
+	})
+	a.s.raft.RegisterObserver(observer)
+	go a.run(observer)
+}
+
+func (a *Autopilot) Stop() {
+	close(a.stopCh)
+}
+
+func (a *Autopilot) run(observer *raft.Observer) {
+	defer a.s.raft.DeregisterObserver(observer)
+	ticker := time.NewTicker(AutopilotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case o := <-a.obsCh:
+			a.observe(o)
+		case <-ticker.C:
+			if a.s.raft.State() == raft.Leader {
+				a.pruneDeadServers()
+				a.promoteStableServers()
+			}
+		case <-a.stopCh:
+			return
+		}
+	}
+}
+
+func (a *Autopilot) observe(o raft.Observation) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch obs := o.Data.(type) {
+	case raft.FailedHeartbeatObservation:
+		if _, known := a.failing[obs.PeerID]; !known {
+			log.Warn("autopilot: peer unreachable", "peerId", obs.PeerID, "lastContact", obs.LastContact)
+			a.failing[obs.PeerID] = obs.LastContact
+		}
+		delete(a.healthy, obs.PeerID) // restart the stabilization period
+	case raft.ResumedHeartbeatObservation:
+		log.Info("autopilot: peer reachable again", "peerId", obs.PeerID)
+		delete(a.failing, obs.PeerID)
+	case raft.PeerObservation:
+		if obs.Removed {
+			delete(a.failing, obs.Peer.ID)
+			delete(a.healthy, obs.Peer.ID)
+		}
+	case raft.LeaderObservation:
+		// Contact times are only tracked by the leader, start over on every change.
+		a.failing = make(map[raft.ServerID]time.Time)
+		a.healthy = make(map[raft.ServerID]time.Time)
+	}
+}
+
+func (a *Autopilot) servers() ([]raft.Server, error) {
+	configFuture := a.s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, err
+	}
+	return configFuture.Configuration().Servers, nil
+}
+
+func (a *Autopilot) pruneDeadServers() {
+	servers, err := a.servers()
+	if err != nil {
+		log.Error("autopilot: failed to read configuration", "error", err)
+		return
+	}
+	voters := 0
+	for _, srv := range servers {
+		if srv.Suffrage == raft.Voter {
+			voters++
+		}
+	}
+	a.mu.Lock()
+	var dead []raft.Server
+	for _, srv := range servers {
+		if lastContact, failing := a.failing[srv.ID]; failing && time.Since(lastContact) > a.deadAfter {
+			dead = append(dead, srv)
+		}
+	}
+	a.mu.Unlock()
+	for _, srv := range dead {
+		if srv.Suffrage == raft.Voter {
+			if voters-1 < a.minQuorum {
+				log.Warn("autopilot: not removing dead server, quorum would drop below minimum",
+					"peerId", srv.ID, "voters", voters, "minQuorum", a.minQuorum)
+				continue
+			}
+			voters--
+		}
+		log.Info("autopilot: removing dead server", "peerId", srv.ID)
+		if err := a.s.RaftLeave(string(srv.ID), a.s.systemOrigin("autopilot")); err != nil {
+			log.Error("autopilot: failed to remove dead server", "peerId", srv.ID, "error", err)
+		}
+	}
+}
+
+func (a *Autopilot) promoteStableServers() {
+	servers, err := a.servers()
+	if err != nil {
+		log.Error("autopilot: failed to read configuration", "error", err)
+		return
+	}
+	candidates := a.stableNonvoters(servers)
+	leaderIdx := a.s.raft.LastIndex()
+	for _, srv := range candidates {
+		stats, err := a.s.peerStats(string(srv.ID), PeerStatsTimeout)
+		if err != nil {
+			log.Warn("autopilot: failed to query staged server", "peerId", srv.ID, "error", err)
+			continue
+		}
+		lastIdx, _ := strconv.ParseUint(stats["last_log_index"], 10, 64)
+		if lastIdx+AutopilotMaxTrailLogs < leaderIdx {
+			log.Debug("autopilot: staged server still catching up", "peerId", srv.ID, "lastIndex", lastIdx, "leaderIndex", leaderIdx)
+			continue
+		}
+		log.Info("autopilot: promoting stable server", "peerId", srv.ID)
+		if err := a.s.RaftPromote(string(srv.ID), a.s.systemOrigin("autopilot")); err != nil {
+			log.Error("autopilot: failed to promote server", "peerId", srv.ID, "error", err)
+			continue
+		}
+		a.mu.Lock()
+		delete(a.healthy, srv.ID)
+		a.mu.Unlock()
+	}
+}
+
+// stableNonvoters tracks since when the staged non-voters of the configuration have been
+// healthy, and returns those healthy for at least stableAfter.
+func (a *Autopilot) stableNonvoters(servers []raft.Server) []raft.Server {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	healthy := make(map[raft.ServerID]time.Time)
+	var stable []raft.Server
+	for _, srv := range servers {
+		if _, failing := a.failing[srv.ID]; failing || srv.Suffrage != raft.Nonvoter {
+			continue
+		}
+		if staged, err := a.s.store.IsStaged(string(srv.ID)); err != nil || !staged {
+			continue
+		}
+		since, known := a.healthy[srv.ID]
+		if !known {
+			since = now
+		}
+		healthy[srv.ID] = since
+		if now.Sub(since) >= a.stableAfter {
+			stable = append(stable, srv)
+		}
+	}
+	a.healthy = healthy
+	return stable
+}
+
+// Health reports the membership health as seen by this node's autopilot.
+func (a *Autopilot) Health() ([]VpServerHealth, error) {
+	servers, err := a.servers()
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	health := make([]VpServerHealth, 0, len(servers))
+	for _, srv := range servers {
+		lastContact, failing := a.failing[srv.ID]
+		h := VpServerHealth{ID: string(srv.ID), Suffrage: srv.Suffrage.String(), Healthy: !failing}
+		if failing {
+			h.LastContact = lastContact
+		}
+		if since, staged := a.healthy[srv.ID]; staged {
+			h.StagedSince = since
+		}
+		health = append(health, h)
+	}
+	return health, nil
+}
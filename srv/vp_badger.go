@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
@@ -12,7 +13,10 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/dgraph-io/badger"
 	"github.com/hashicorp/raft"
 )
@@ -20,21 +24,39 @@ import (
 const (
 	CMDSET       = "SET"
 	CMDDEL       = "DEL"
+	CMDACLSET    = "ACLSET"
+	CMDACLDEL    = "ACLDEL"
+	CMDMEMBER    = "MEMBER" // recorded in the audit log, clears the staging of the peer
+	CMDSTAGE     = "STAGE"  // a join staged for promotion by autopilot, also recorded in the audit log
+	CMDBATCH     = "BATCH"
 	BDGLOGPREFIX = "rft:"
 	BDGSSTPREFIX = "sst:"
 	BDGDATPREFIX = "dat:"
 	BDGU64PREFIX = "u64:"
+	BDGACLPREFIX = "acl:"
+	BDGAUDPREFIX = "aud:"
+	BDGIDMPREFIX = "idm:"
+	BDGIDTPREFIX = "idt:"
+	BDGSTGPREFIX = "stg:"
+	BDGMAXKEY    = 65000 // badger's limit on the size of keys
 )
 
 type VpLogCmd struct {
-	Op    string
-	Key   string
-	Value []byte
+	Op     string
+	Key    string
+	Value  []byte
+	Origin *VpOrigin
+	Trace  string     // W3C traceparent of the span which submitted the command
+	Batch  []VpLogCmd // commands of a BATCH
+	Id     string     // idempotency key given by the client
+	Cond   *VpCondition
 }
 
 type VpRpcResponse struct {
-	Error error
-	Data  []byte
+	Error    error
+	Data     []byte
+	Replayed bool             // an earlier write with the same idempotency key was applied instead
+	Batch    []*VpRpcResponse // per command results of a BATCH
 }
 
 type VpKeyPage struct {
@@ -43,7 +65,9 @@ type VpKeyPage struct {
 	PageSize uint16
 }
 
-type Snapshot struct{}
+type Snapshot struct {
+	txn *badger.Txn
+}
 
 type IteratorRange struct{ from, to uint64 }
 
@@ -52,7 +76,16 @@ var (
 	dbDatPrefix    = []byte(BDGDATPREFIX)
 	dbU64Prefix    = []byte(BDGU64PREFIX)
 	dbSstPrefix    = []byte(BDGSSTPREFIX)
+	dbAclPrefix    = []byte(BDGACLPREFIX)
+	dbAudPrefix    = []byte(BDGAUDPREFIX)
+	dbIdmPrefix    = []byte(BDGIDMPREFIX)
+	dbIdtPrefix    = []byte(BDGIDTPREFIX)
+	dbStgPrefix    = []byte(BDGSTGPREFIX)
 	ErrKeyNotFound = errors.New("not found")
+	ErrTxnTooLarge = errors.New("write too large to be applied in a single transaction")
+
+	// key spaces of the state machine, i.e. of snapshots, as opposed to raft's own storage
+	fsmPrefixes = [][]byte{dbDatPrefix, dbAclPrefix, dbAudPrefix, dbIdmPrefix, dbIdtPrefix, dbStgPrefix}
 )
 
 /*
@@ -63,7 +96,12 @@ var (
 	and https://godoc.org/github.com/hashicorp/raft#LogStore
 */
 type BadgerStore struct {
-	db *badger.DB
+	keys    int64 // data keys, counted at open then kept by Apply and Restore; first for 64-bit alignment
+	db      *badger.DB
+	closed  int32
+	appends appendWaiters
+
+	valueThreshold int // values of at least this size are stored in the value log
 }
 
 func NewBadgerStore(path string) (*BadgerStore, error) {
@@ -72,7 +110,12 @@ func NewBadgerStore(path string) (*BadgerStore, error) {
 	if err != nil {
 		log.Error("Badger store error", "cause", err)
 	}
-	store := &BadgerStore{db: db}
+	store := &BadgerStore{db: db, valueThreshold: opts.ValueThreshold}
+	if err == nil {
+		if store.keys, err = store.countKeys(); err != nil {
+			log.Error("Badger store error", "cause", err)
+		}
+	}
 	return store, nil
 }
 
@@ -122,6 +165,27 @@ func sstKeyOf(rawKey []byte) []byte {
 	return []byte(key)
 }
 
+func aclKeyOf(rawKey []byte) []byte {
+	key := fmt.Sprintf("%s%s", dbAclPrefix, hex.EncodeToString(rawKey))
+	if log.IsTrace() {
+		log.Trace("badger key", "acl", key)
+	}
+	return []byte(key)
+}
+
+func stgKeyOf(peerId string) []byte {
+	return []byte(fmt.Sprintf("%s%s", dbStgPrefix, hex.EncodeToString([]byte(peerId))))
+}
+
+func isFsmKey(key []byte) bool {
+	for _, prefix := range fsmPrefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *BadgerStore) generateRanges(min, max uint64, batchSize int64) []IteratorRange {
 	nSegments := int(math.Round(float64((max - min) / uint64(batchSize))))
 	segments := []IteratorRange{}
@@ -232,6 +296,7 @@ func (b *BadgerStore) StoreLogs(logs []*raft.Log) error {
 			return err
 		}
 	}
+	b.notifyAppended(logs)
 	return nil
 }
 
@@ -316,7 +381,8 @@ func (b *BadgerStore) DeleteRaw(key []byte) error {
                             Data access operations
 ================================================================================== */
 
-func (b *BadgerStore) KeysOf(prefix []byte, offset []byte, pageSize uint16) (*VpKeyPage, error) {
+// KeysOf lists a page of the keys under prefix from offset, skipping those visible rejects, if set.
+func (b *BadgerStore) KeysOf(prefix []byte, offset []byte, pageSize uint16, visible func(key string) bool) (*VpKeyPage, error) {
 	keys := make([]string, 0)
 	keyPfx := dataKeyOf(prefix)
 	keyOff := dataKeyOf(offset)
@@ -330,6 +396,10 @@ func (b *BadgerStore) KeysOf(prefix []byte, offset []byte, pageSize uint16) (*Vp
 			rk := strings.Replace(string(it.Item().Key()), BDGDATPREFIX, "", 1)
 			k, _ := hex.DecodeString(rk)
 			itKey := string(k)
+			if visible != nil && !visible(itKey) {
+				it.Next()
+				continue
+			}
 			if i < pageSize {
 				keys = append(keys, string(k))
 				it.Next()
@@ -353,10 +423,65 @@ func (b *BadgerStore) KeysOf(prefix []byte, offset []byte, pageSize uint16) (*Vp
 	return &res, nil
 }
 
+// KeyCount returns the number of data keys, as of the last applied entry.
+func (b *BadgerStore) KeyCount() uint64 {
+	return uint64(atomic.LoadInt64(&b.keys))
+}
+
+// countKeys counts the data keys, without reading their values.
+func (b *BadgerStore) countKeys() (int64, error) {
+	var n int64
+	err := b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(dbDatPrefix); it.ValidForPrefix(dbDatPrefix); it.Next() {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
 func (b *BadgerStore) GetData(key []byte) ([]byte, error) {
 	return b.GetRaw(dataKeyOf(key))
 }
 
+// IsStaged tells whether autopilot may promote peerId, which joined as a voter.
+func (b *BadgerStore) IsStaged(peerId string) (bool, error) {
+	_, err := b.GetRaw(stgKeyOf(peerId))
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *BadgerStore) GetAcl(key []byte) ([]byte, error) {
+	return b.GetRaw(aclKeyOf(key))
+}
+
+// AclValuesOf returns the values of all ACL entries whose key starts with prefix.
+func (b *BadgerStore) AclValuesOf(prefix []byte) ([][]byte, error) {
+	values := make([][]byte, 0)
+	keyPfx := aclKeyOf(prefix)
+	if err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(keyPfx); it.ValidForPrefix(keyPfx); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
 /* ==================================================================================
                             Additional implementations
 ================================================================================== */
@@ -385,6 +510,98 @@ func (b *BadgerStore) GetUint64(key []byte) (uint64, error) {
 	return bytesToUint64(val), nil
 }
 
+// mutationOf returns the change a log command makes to the store, and the data it responds with.
+func mutationOf(cmd *VpLogCmd) (func(txn *badger.Txn) error, []byte, error) {
+	switch cmd.Op {
+	case CMDSET:
+		return func(txn *badger.Txn) error { return txn.Set(dataKeyOf([]byte(cmd.Key)), cmd.Value) }, cmd.Value, nil
+	case CMDDEL:
+		return func(txn *badger.Txn) error { return txn.Delete(dataKeyOf([]byte(cmd.Key))) }, nil, nil
+	case CMDACLSET:
+		return func(txn *badger.Txn) error { return txn.Set(aclKeyOf([]byte(cmd.Key)), cmd.Value) }, nil, nil
+	case CMDACLDEL:
+		return func(txn *badger.Txn) error { return txn.Delete(aclKeyOf([]byte(cmd.Key))) }, nil, nil
+	case CMDMEMBER:
+		return func(txn *badger.Txn) error { return txn.Delete(stgKeyOf(cmd.Key)) }, nil, nil
+	case CMDSTAGE:
+		return func(txn *badger.Txn) error { return txn.Set(stgKeyOf(cmd.Key), []byte{}) }, nil, nil
+	}
+	return nil, nil, fmt.Errorf("invalid log command: [%s]", cmd.Op)
+}
+
+// keysAddedBy returns how a log command changes the number of data keys: 1 when it sets a
+// missing key, -1 when it deletes an existing one.
+func keysAddedBy(txn *badger.Txn, cmd *VpLogCmd) (int64, error) {
+	if cmd.Op != CMDSET && cmd.Op != CMDDEL {
+		return 0, nil
+	}
+	_, err := txn.Get(dataKeyOf([]byte(cmd.Key)))
+	switch {
+	case err == badger.ErrKeyNotFound && cmd.Op == CMDSET:
+		return 1, nil
+	case err == nil && cmd.Op == CMDDEL:
+		return -1, nil
+	case err == badger.ErrKeyNotFound || err == nil:
+		return 0, nil
+	}
+	return 0, err
+}
+
+// entryCost estimates an entry of a transaction like badger: its key and version, and its value
+// when small enough to be stored in the tree, or else a pointer to the value log.
+func (b *BadgerStore) entryCost(key []byte, valueLen int) int64 {
+	if valueLen >= b.valueThreshold {
+		valueLen = 12
+	}
+	return int64(len(key) + 10 + valueLen + 2)
+}
+
+/*
+	CheckTxn refuses a command which badger would fail to apply once committed to the log, because
+	of a key too large or of a transaction with too many entries or bytes. Audit and idempotency
+	records are counted, as well as the deletion of expired idempotency records and audit entries.
+*/
+func (b *BadgerStore) CheckTxn(cmd *VpLogCmd) error {
+	cmds := []VpLogCmd{*cmd}
+	if cmd.Op == CMDBATCH {
+		cmds = cmd.Batch
+	}
+	count, size := int64(0), int64(0)
+	add := func(key []byte, valueLen int) {
+		count, size = count+1, size+b.entryCost(key, valueLen)
+	}
+	idempotent := func(id string) {
+		if len(id) > 0 {
+			add(idmKeyOf(id), b.valueThreshold)
+			add(idtKeyOf(0, id), len(id))
+		}
+	}
+	for i := range cmds {
+		key := dataKeyOf([]byte(cmds[i].Key))
+		if len(key) > BDGMAXKEY {
+			return ErrTxnTooLarge
+		}
+		add(key, len(cmds[i].Value))
+		add(batchAuditKeyOf(0, i), b.valueThreshold) // audit records hold the key and more
+		idempotent(cmds[i].Id)
+	}
+	if cmd.Op == CMDBATCH {
+		idempotent(cmd.Id)
+	}
+	expired := strings.Repeat("-", MaxRequestIdSize)
+	for i := 0; i < IdempotencyPruneMax; i++ {
+		add(idmKeyOf(expired), 0)
+		add(idtKeyOf(0, expired), 0)
+	}
+	for i := 0; i < AuditPruneMax; i++ {
+		add(batchAuditKeyOf(0, i), 0)
+	}
+	if count >= b.db.MaxBatchCount() || size >= b.db.MaxBatchSize() {
+		return ErrTxnTooLarge
+	}
+	return nil
+}
+
 func (b *BadgerStore) Apply(rLog *raft.Log) interface{} {
 	switch rLog.Type {
 	case raft.LogCommand:
@@ -393,33 +610,239 @@ func (b *BadgerStore) Apply(rLog *raft.Log) interface{} {
 			log.Error("error un-marshaling payload", "cause", err.Error())
 			return nil
 		}
-		switch payload.Op {
-		case CMDSET:
-			return &VpRpcResponse{Error: b.SetRaw(dataKeyOf([]byte(payload.Key)), payload.Value), Data: payload.Value}
-		case CMDDEL:
-			return &VpRpcResponse{Error: b.DeleteRaw(dataKeyOf([]byte(payload.Key))), Data: nil}
-		default:
-			log.Warn("Invalid Raft log command", "payload", payload.Op)
+		defer metrics.MeasureSinceWithLabels([]string{"fsm", "apply"}, time.Now(), []metrics.Label{{Name: "op", Value: payload.Op}})
+		var res *VpRpcResponse
+		var added int64
+		err := b.db.Update(func(txn *badger.Txn) error {
+			var err error
+			res, added, err = b.applyIn(txn, rLog, &payload)
+			return err
+		})
+		if err != nil {
+			return &VpRpcResponse{Error: err}
 		}
+		atomic.AddInt64(&b.keys, added)
+		return res
 	}
 	log.Info("Raft log command", "type", raft.LogCommand)
 	return nil
 }
 
+/*
+	applyIn applies a log command, or the commands of a batch, with their audit records in one
+	transaction. Commands with an idempotency key which was already applied are skipped, and
+	answered as replayed. Any error rolls the whole entry back. The number of data keys added,
+	or removed when negative, is returned for KeyCount.
+*/
+func (b *BadgerStore) applyIn(txn *badger.Txn, rLog *raft.Log, payload *VpLogCmd) (*VpRpcResponse, int64, error) {
+	now := rLog.AppendedAt
+	if a, err := appliedOf(txn, payload, now); err != nil {
+		return nil, 0, err
+	} else if a != nil {
+		log.Info("skipping replayed log command", "index", rLog.Index, "op", payload.Op, "first_index", a.Index)
+		metrics.IncrCounter([]string{"fsm", "replayed"}, 1)
+		return a.response(payload), 0, nil
+	}
+	cmds := []VpLogCmd{*payload}
+	if payload.Op == CMDBATCH { // the commands of a batch are applied atomically, in one transaction
+		cmds = payload.Batch
+	}
+	var data []byte
+	var added int64
+	results := make([]*VpRpcResponse, len(cmds))
+	pending := make(map[string]*VpApplied) // idempotency keys applied earlier in this batch
+	spans := make([]*Span, 0, len(cmds))
+	defer func() {
+		for _, span := range spans {
+			span.End()
+		}
+	}()
+	for i := range cmds {
+		cmd := &cmds[i]
+		mutate, d, err := mutationOf(cmd)
+		if err != nil {
+			log.Warn("Invalid Raft log command", "payload", cmd.Op)
+			return nil, 0, err
+		}
+		if payload.Op == CMDBATCH && len(cmd.Id) > 0 {
+			if a, err := appliedOf(txn, cmd, now); err != nil {
+				return nil, 0, err
+			} else if a != nil {
+				results[i] = a.response(cmd)
+				continue
+			} else if a := pending[cmd.Id]; a != nil {
+				results[i] = a.response(cmd)
+				continue
+			}
+			pending[cmd.Id] = &VpApplied{Principal: principalOfOrigin(cmd.Origin), Hash: payloadHashOf(cmd)}
+		}
+		if err := preconditionOf(txn, cmd); err == ErrPreconditionFailed {
+			if payload.Op != CMDBATCH {
+				return &VpRpcResponse{Error: err}, 0, nil
+			}
+			results[i] = &VpRpcResponse{Error: err}
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		entry := auditEntryOf(rLog, cmd)
+		if log.IsDebug() {
+			log.Debug("applying log command", "index", rLog.Index, "op", cmd.Op, "key", cmd.Key, "request_id", entry.RequestId)
+		}
+		span := StartRemoteSpan(cmd.Trace, "badger.apply", SpanInternal)
+		spans = append(spans, span)
+		span.SetAttr("vephar.op", cmd.Op)
+		span.SetAttr("raft.index", rLog.Index)
+		span.SetAttr("vephar.batch_size", len(cmds))
+		audit, err := json.Marshal(entry)
+		if err != nil {
+			return nil, 0, err
+		}
+		key := auditKeyOf(rLog.Index)
+		if payload.Op == CMDBATCH {
+			key = batchAuditKeyOf(rLog.Index, i)
+		}
+		n, err := keysAddedBy(txn, cmd)
+		if err != nil {
+			return nil, 0, err
+		}
+		added += n
+		if err := mutate(txn); err != nil { // changes and their audit records commit together
+			span.SetError(err)
+			return nil, 0, err
+		}
+		if err := txn.Set(key, audit); err != nil {
+			return nil, 0, err
+		}
+		if len(cmd.Id) > 0 {
+			if err := recordApplied(txn, rLog.Index, cmd, now); err != nil {
+				return nil, 0, err
+			}
+		}
+		results[i], data = &VpRpcResponse{Data: d}, d
+	}
+	if payload.Op != CMDBATCH {
+		return &VpRpcResponse{Data: data}, added, pruneExpired(txn, now)
+	}
+	if len(payload.Id) > 0 {
+		if err := recordApplied(txn, rLog.Index, payload, now); err != nil {
+			return nil, 0, err
+		}
+	}
+	return &VpRpcResponse{Batch: results}, added, pruneExpired(txn, now)
+}
+
+// pruneExpired removes a bounded number of expired idempotency records and audit entries.
+func pruneExpired(txn *badger.Txn, now time.Time) error {
+	if err := pruneApplied(txn, now); err != nil {
+		return err
+	}
+	return pruneAudit(txn, now)
+}
+
+// Size returns the on-disk size of the LSM tree and the value log.
+func (b *BadgerStore) Size() (lsm, vlog int64) {
+	return b.db.Size()
+}
+
+// IsOpen reports whether the database was opened and has not been closed since.
+func (b *BadgerStore) IsOpen() bool {
+	return b.db != nil && atomic.LoadInt32(&b.closed) == 0
+}
+
 func (b *BadgerStore) Close() error {
+	atomic.StoreInt32(&b.closed, 1)
 	return b.db.Close()
 }
 
+/*
+	Snapshot captures the state machine at the last applied entry, from a read transaction which
+	Persist then streams to the sink as length-prefixed keys and values, in key order.
+*/
 func (b *BadgerStore) Snapshot() (raft.FSMSnapshot, error) {
-	return &Snapshot{}, nil
+	return &Snapshot{txn: b.db.NewTransaction(false)}, nil
 }
 
+// Restore replaces the state machine with the content of a snapshot.
 func (b *BadgerStore) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	if err := b.db.DropPrefix(fsmPrefixes...); err != nil {
+		return err
+	}
+	r := bufio.NewReader(rc)
+	read := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r, buf)
+		return buf, err
+	}
+	wb := b.db.NewWriteBatch()
+	var keys int64
+	for {
+		k, err := read()
+		if err == io.EOF {
+			break
+		}
+		var v []byte
+		if err == nil {
+			v, err = read()
+		}
+		if err == nil && !isFsmKey(k) {
+			err = fmt.Errorf("unexpected snapshot key: [%s]", k)
+		}
+		if err == nil {
+			err = wb.Set(k, v)
+		}
+		if err != nil {
+			wb.Cancel()
+			return err
+		}
+		if bytes.HasPrefix(k, dbDatPrefix) {
+			keys++
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&b.keys, keys)
 	return nil
 }
 
-func (s Snapshot) Persist(_ raft.SnapshotSink) error {
-	return nil
+func (s *Snapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	buf := make([]byte, binary.MaxVarintLen64)
+	write := func(b []byte) error {
+		if _, err := w.Write(buf[:binary.PutUvarint(buf, uint64(len(b)))]); err != nil {
+			return err
+		}
+		_, err := w.Write(b)
+		return err
+	}
+	err := func() error {
+		it := s.txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for _, prefix := range fsmPrefixes {
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				if err := write(it.Item().Key()); err != nil {
+					return err
+				}
+				if err := it.Item().Value(write); err != nil {
+					return err
+				}
+			}
+		}
+		return w.Flush()
+	}()
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
 }
 
-func (s Snapshot) Release() {}
+func (s *Snapshot) Release() {
+	s.txn.Discard()
+}
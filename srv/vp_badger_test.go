@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/hashicorp/raft"
+)
+
+// testSink collects a snapshot in memory.
+type testSink struct {
+	bytes.Buffer
+	canceled bool
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Close() error  { return nil }
+func (s *testSink) Cancel() error { s.canceled = true; return nil }
+
+// dumpOf reads the keys and values under prefixes.
+func dumpOf(t *testing.T, store *BadgerStore, prefixes ...[]byte) map[string]string {
+	dump := make(map[string]string)
+	err := store.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for _, prefix := range prefixes {
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				v, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				dump[string(it.Item().Key())] = string(v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dump
+}
+
+// TestSnapshotRestore checks that a snapshot carries every key space of the state machine, and
+// that restoring it replaces them while leaving raft's own storage alone.
+func TestSnapshotRestore(t *testing.T) {
+	src, dst := newTestStore(t), newTestStore(t)
+	now := time.Now()
+	applyCmdAt(t, src, 1, &VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("1"), Id: "x"}, now)
+	applyCmdAt(t, src, 2, &VpLogCmd{Op: CMDACLSET, Key: AclPolicyKind + "p", Value: []byte("{}")}, now)
+	applyCmdAt(t, src, 3, &VpLogCmd{Op: CMDBATCH, Batch: []VpLogCmd{{Op: CMDSET, Key: "b", Value: []byte("2")}, {Op: CMDDEL, Key: "a"}}}, now)
+	applyCmdAt(t, src, 4, &VpLogCmd{Op: CMDSTAGE, Key: "node:9090:8080"}, now)
+	if err := src.StoreLog(&raft.Log{Index: 3, Data: []byte("log")}); err != nil {
+		t.Fatal(err)
+	}
+	applyCmdAt(t, dst, 1, &VpLogCmd{Op: CMDSET, Key: "stale", Value: []byte("1"), Id: "stale"}, now)
+	applyCmdAt(t, dst, 2, &VpLogCmd{Op: CMDACLSET, Key: AclPolicyKind + "stale", Value: []byte("{}")}, now)
+	if err := dst.SetUint64([]byte("CurrentTerm"), 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.StoreLog(&raft.Log{Index: 9, Data: []byte("own log")}); err != nil {
+		t.Fatal(err)
+	}
+	raftOwn := dumpOf(t, dst, dbLogPrefix, dbU64Prefix)
+
+	want := dumpOf(t, src, fsmPrefixes...)
+	for _, prefix := range fsmPrefixes {
+		if len(dumpOf(t, src, prefix)) == 0 {
+			t.Fatalf("nothing stored under %s", prefix)
+		}
+	}
+	snap, err := src.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &testSink{}
+	err = snap.Persist(sink)
+	snap.Release()
+	if err != nil || sink.canceled {
+		t.Fatalf("persist: %v, canceled %v", err, sink.canceled)
+	}
+	if err := dst.Restore(ioutil.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatal(err)
+	}
+	got := dumpOf(t, dst, fsmPrefixes...)
+	if len(got) != len(want) {
+		t.Errorf("%d keys restored, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: restored %q, want %q", k, got[k], v)
+		}
+	}
+	for k, v := range dumpOf(t, dst, dbLogPrefix, dbU64Prefix) {
+		if raftOwn[k] != v {
+			t.Errorf("raft key %s changed by the restore", k)
+		}
+	}
+	if len(dumpOf(t, dst, dbLogPrefix, dbU64Prefix)) != len(raftOwn) {
+		t.Error("raft keys changed by the restore")
+	}
+}
+
+// TestKeyCount checks that the key count follows writes, failed ones included, restores and reopening.
+func TestKeyCount(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewBadgerStore(dir)
+	if !store.IsOpen() {
+		t.Fatal("failed to open the store")
+	}
+	check := func(store *BadgerStore, step string) {
+		if n, err := store.countKeys(); err != nil || store.KeyCount() != uint64(n) {
+			t.Errorf("%s: %d keys counted, %d stored (%v)", step, store.KeyCount(), n, err)
+		}
+	}
+	set := func(key string) VpLogCmd { return VpLogCmd{Op: CMDSET, Key: key, Value: []byte("v")} }
+	del := func(key string) VpLogCmd { return VpLogCmd{Op: CMDDEL, Key: key} }
+	for i, cmd := range []VpLogCmd{
+		set("a"), set("b"), set("a"), del("missing"), del("b"),
+		{Op: CMDACLSET, Key: AclPolicyKind + "p", Value: []byte("{}")},
+		{Op: CMDSET, Key: "a", Value: []byte("v"), Cond: &VpCondition{IfNoneMatch: AnyETag}},
+		{Op: CMDBATCH, Batch: []VpLogCmd{set("c"), set("c"), del("a"), set("a"), set("d")}},
+		{Op: CMDBATCH, Batch: []VpLogCmd{set("e"), {Op: "BAD"}}},
+	} {
+		applyCmd(t, store, uint64(i+1), &cmd)
+		check(store, fmt.Sprint(cmd.Op, " ", i))
+	}
+	if store.KeyCount() != 3 {
+		t.Errorf("%d keys, want 3", store.KeyCount())
+	}
+
+	snap, err := store.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &testSink{}
+	err = snap.Persist(sink)
+	snap.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := newTestStore(t)
+	applyCmd(t, dst, 1, &VpLogCmd{Op: CMDSET, Key: "stale", Value: []byte("v")})
+	if err := dst.Restore(ioutil.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatal(err)
+	}
+	check(dst, "restore")
+
+	store.Close()
+	store, _ = NewBadgerStore(dir)
+	if !store.IsOpen() {
+		t.Fatal("failed to reopen the store")
+	}
+	defer store.Close()
+	if store.KeyCount() != 3 {
+		t.Errorf("%d keys after reopening, want 3", store.KeyCount())
+	}
+}
+
+// TestRestoreRefusesForeignKeys checks that a snapshot can't write outside of the state machine.
+func TestRestoreRefusesForeignKeys(t *testing.T) {
+	store := newTestStore(t)
+	var snap bytes.Buffer
+	for _, b := range [][]byte{logKeyOf(1), []byte("log")} {
+		snap.WriteByte(byte(len(b)))
+		snap.Write(b)
+	}
+	if err := store.Restore(ioutil.NopCloser(&snap)); err == nil {
+		t.Error("snapshot with a raft log key restored")
+	}
+	if len(dumpOf(t, store, dbLogPrefix)) != 0 {
+		t.Error("raft log key written by a restore")
+	}
+}
+
+func bulkCmdOf(n, keySize, valueSize int, id string) *VpLogCmd {
+	o := &VpOrigin{Principal: "p", Node: "127.0.0.1:9090:8080", Client: "127.0.0.1:5555", RequestId: strings.Repeat("r", 32)}
+	cmd := &VpLogCmd{Op: CMDBATCH, Id: id, Origin: o, Batch: make([]VpLogCmd, n)}
+	for i := range cmd.Batch {
+		cmd.Batch[i] = VpLogCmd{Op: CMDSET, Key: fmt.Sprintf("%0*d", keySize, i), Value: make([]byte, valueSize), Origin: o}
+	}
+	return cmd
+}
+
+// TestCheckTxn checks that bulk requests within the limits apply, and that the estimate refuses
+// those which would fail to apply once committed.
+func TestCheckTxn(t *testing.T) {
+	store := newTestStore(t)
+	index := uint64(0)
+	for _, c := range []struct {
+		n, keySize, valueSize int
+	}{
+		{BulkMaxOps, BatchMaxBytes/BulkMaxOps - 4, 4},
+		{BulkMaxOps, 8, BatchMaxBytes/BulkMaxOps - 8},
+		{BulkMaxOps, 8, 16},
+		{1, 8, BatchMaxBytes},
+		{20000, 300, 0},
+		{28000, 300, 0},
+		{32000, 300, 0},
+		{40000, 200, 0},
+		{120000, 8, 0},
+	} {
+		index++
+		cmd := bulkCmdOf(c.n, c.keySize, c.valueSize, fmt.Sprint("bulk-", index))
+		checked := store.CheckTxn(cmd)
+		res := applyCmd(t, store, index, cmd)
+		if c.n <= BulkMaxOps && (checked != nil || res.Error != nil) {
+			t.Errorf("%+v within the bulk limits: checked %v, applied %v", c, checked, res.Error)
+		} else if checked == nil && res.Error != nil {
+			t.Errorf("%+v accepted, but failed to apply: %v", c, res.Error)
+		}
+	}
+	if err := store.CheckTxn(&VpLogCmd{Op: CMDSET, Key: strings.Repeat("k", BDGMAXKEY)}); err != ErrTxnTooLarge {
+		t.Errorf("key larger than badger's limit: %v", err)
+	}
+}
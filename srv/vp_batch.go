@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	BatchMaxBytes = 4 << 20 // keeps batches well below badger's transaction size limit
+)
+
+type applyResult struct {
+	index uint64
+	res   *VpRpcResponse
+	err   error
+}
+
+type pendingWrite struct {
+	ctx      context.Context
+	cmd      *VpLogCmd
+	size     int
+	deadline time.Time // when its writer stops waiting
+	done     chan applyResult
+}
+
+/*
+	Batcher coalesces concurrent writes on the leader into BATCH log entries, which
+	BadgerStore.Apply commits in a single transaction. A batch is closed once it holds
+	maxSize writes, BatchMaxBytes of values, or window after its first write; writes
+	arriving while a batch commits accumulate in the next one. Batches which would exceed
+	badger's transaction limits are split, and writes whose writer stopped waiting meanwhile
+	are left out.
+*/
+type Batcher struct {
+	s       *Server
+	window  time.Duration
+	maxSize int
+	queue   chan *pendingWrite
+	done    chan struct{}
+}
+
+func NewBatcher(s *Server, window time.Duration, maxSize int) *Batcher {
+	return &Batcher{s: s, window: window, maxSize: maxSize, queue: make(chan *pendingWrite, maxSize), done: make(chan struct{})}
+}
+
+func (b *Batcher) Start() {
+	go b.run()
+}
+
+func (b *Batcher) Stop() {
+	close(b.done)
+}
+
+func (b *Batcher) run() {
+	var carry *pendingWrite
+	for {
+		first := carry
+		if first == nil {
+			select {
+			case first = <-b.queue:
+			case <-b.done:
+				return
+			}
+		}
+		batch, bytes := []*pendingWrite{first}, first.size
+		carry = nil
+		timer := time.NewTimer(b.window)
+	collect:
+		for len(batch) < b.maxSize {
+			select {
+			case p := <-b.queue:
+				if bytes+p.size > BatchMaxBytes {
+					carry = p
+					break collect
+				}
+				batch, bytes = append(batch, p), bytes+p.size
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		b.commit(batch)
+	}
+}
+
+/*
+	commit appends a batch to the log and fans the result out to its writers once applied. The
+	batch is split in halves while too large for a transaction as a whole, though each write fits.
+	Raft may take until the earliest deadline of the writers to accept the entry.
+*/
+func (b *Batcher) commit(batch []*pendingWrite) {
+	waiting := batch[:0]
+	deadline := time.Time{}
+	for _, p := range batch {
+		if p.ctx.Err() != nil || !time.Now().Before(p.deadline) {
+			continue // answered by Submit already
+		}
+		if waiting = append(waiting, p); deadline.IsZero() || p.deadline.Before(deadline) {
+			deadline = p.deadline
+		}
+	}
+	if batch = waiting; len(batch) == 0 {
+		return
+	}
+	cmd := batch[0].cmd
+	if len(batch) > 1 {
+		cmd = &VpLogCmd{Op: CMDBATCH, Batch: make([]VpLogCmd, len(batch))}
+		for i, p := range batch {
+			cmd.Batch[i] = *p.cmd
+		}
+		if err := b.s.store.CheckTxn(cmd); err != nil {
+			metrics.IncrCounter([]string{"raft", "batch", "split"}, 1)
+			b.commit(batch[:len(batch)/2])
+			b.commit(batch[len(batch)/2:])
+			return
+		}
+	}
+	metrics.AddSample([]string{"raft", "batch", "size"}, float32(len(batch)))
+	buff, err := json.Marshal(cmd)
+	if err != nil {
+		for _, p := range batch {
+			p.done <- applyResult{err: err}
+		}
+		return
+	}
+	future := b.s.raft.Apply(buff, time.Until(deadline))
+	go func() {
+		r := applyResult{err: future.Error()}
+		if r.err == nil {
+			r.index = future.Index()
+			r.res, _ = future.Response().(*VpRpcResponse)
+		}
+		for i, p := range batch {
+			pr := r
+			if r.res != nil && r.res.Error == nil && len(r.res.Batch) == len(batch) {
+				pr.res = r.res.Batch[i]
+			}
+			p.done <- pr
+		}
+	}()
+}
+
+// Submit queues a write for the next batch and waits for it to be applied, or for ctx to be done.
+func (b *Batcher) Submit(ctx context.Context, cmd *VpLogCmd, timeout time.Duration) (uint64, *VpRpcResponse, error) {
+	p := &pendingWrite{
+		ctx: ctx, cmd: cmd, size: len(cmd.Key) + len(cmd.Value),
+		deadline: time.Now().Add(timeout), done: make(chan applyResult, 1),
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case b.queue <- p:
+	case <-timer.C:
+		return 0, nil, ErrWriteTimeout
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+	select {
+	case r := <-p.done:
+		return r.index, r.res, r.err
+	case <-timer.C:
+		return 0, nil, ErrWriteTimeout
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+const testPeerId = "localhost:9090:8080"
+
+// newTestLeader runs a single node cluster in memory, with store as state machine, and waits for its leadership.
+func newTestLeader(t *testing.T, store *BadgerStore) *raft.Raft {
+	conf := raft.DefaultConfig()
+	conf.LocalID = testPeerId
+	conf.HeartbeatTimeout, conf.ElectionTimeout = 50*time.Millisecond, 50*time.Millisecond
+	conf.LeaderLeaseTimeout, conf.CommitTimeout = 50*time.Millisecond, 5*time.Millisecond
+	conf.Logger = hclog.NewNullLogger()
+	addr, trans := raft.NewInmemTransport("")
+	logs := raft.NewInmemStore()
+	r, err := raft.NewRaft(conf, store, logs, logs, raft.NewInmemSnapshotStore(), trans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Shutdown().Error() })
+	if err := r.BootstrapCluster(raft.Configuration{Servers: []raft.Server{{ID: conf.LocalID, Address: addr}}}).Error(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); r.State() != raft.Leader; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader")
+		}
+	}
+	return r
+}
+
+func newTestBatcher(t *testing.T, window time.Duration, maxSize int) (*Batcher, *BadgerStore) {
+	store := newTestStore(t)
+	b := NewBatcher(&Server{store: store, raft: newTestLeader(t, store)}, window, maxSize)
+	b.Start()
+	t.Cleanup(b.Stop)
+	return b, store
+}
+
+type submitted struct {
+	index uint64
+	res   *VpRpcResponse
+	err   error
+}
+
+// submitAll submits cmds concurrently and returns their results in the same order.
+func submitAll(b *Batcher, cmds []*VpLogCmd) []submitted {
+	results := make([]submitted, len(cmds))
+	var wg sync.WaitGroup
+	for i, cmd := range cmds {
+		wg.Add(1)
+		go func(i int, cmd *VpLogCmd) {
+			defer wg.Done()
+			r := &results[i]
+			r.index, r.res, r.err = b.Submit(context.Background(), cmd, 5*time.Second)
+		}(i, cmd)
+	}
+	wg.Wait()
+	return results
+}
+
+// TestBatcherFanOut checks that concurrent writes share a log entry, each with its own result.
+func TestBatcherFanOut(t *testing.T) {
+	b, store := newTestBatcher(t, 200*time.Millisecond, 5)
+	applyCmd(t, store, 1000, &VpLogCmd{Op: CMDSET, Key: "c", Value: []byte("old")})
+	cmds := []*VpLogCmd{
+		{Op: CMDSET, Key: "a", Value: []byte("1")},
+		{Op: CMDSET, Key: "b", Value: []byte("2")},
+		{Op: CMDSET, Key: "c", Value: []byte("3"), Cond: &VpCondition{IfNoneMatch: AnyETag}},
+		{Op: CMDDEL, Key: "d"},
+		{Op: CMDSET, Key: "e", Value: []byte("5")},
+	}
+	results := submitAll(b, cmds)
+	for i, r := range results {
+		if r.err != nil || r.res == nil {
+			t.Fatalf("%d: %v", i, r.err)
+		}
+		if r.index != results[0].index {
+			t.Errorf("%d: index %d, batched writes must share the entry %d", i, r.index, results[0].index)
+		}
+		if failed := r.res.Error == ErrPreconditionFailed; failed != (cmds[i].Key == "c") {
+			t.Errorf("%d: error %v", i, r.res.Error)
+		}
+	}
+	if string(results[1].res.Data) != "2" {
+		t.Errorf("result of a batched write: %q", results[1].res.Data)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "old", "e": "5"} {
+		if v := valueOf(t, store, key); v != want {
+			t.Errorf("%s: %q, want %q", key, v, want)
+		}
+	}
+}
+
+// TestBatcherLimits checks that batches are closed at maxSize writes, and at BatchMaxBytes.
+func TestBatcherLimits(t *testing.T) {
+	b, _ := newTestBatcher(t, 200*time.Millisecond, 2)
+	cmds := make([]*VpLogCmd, 6)
+	for i := range cmds {
+		cmds[i] = &VpLogCmd{Op: CMDSET, Key: fmt.Sprint("k", i), Value: []byte("v")}
+	}
+	entries := make(map[uint64]int)
+	for _, r := range submitAll(b, cmds) {
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		entries[r.index]++
+	}
+	for index, n := range entries {
+		if n > 2 {
+			t.Errorf("%d writes in the entry %d, at most 2", n, index)
+		}
+	}
+
+	b, _ = newTestBatcher(t, 200*time.Millisecond, 10)
+	large := make([]byte, BatchMaxBytes/2+1)
+	results := submitAll(b, []*VpLogCmd{{Op: CMDSET, Key: "a", Value: large}, {Op: CMDSET, Key: "b", Value: large}})
+	if results[0].err != nil || results[1].err != nil {
+		t.Fatal(results[0].err, results[1].err)
+	}
+	if results[0].index == results[1].index {
+		t.Errorf("writes beyond BatchMaxBytes batched together")
+	}
+}
+
+// TestBatcherErrors checks that a batch failing as a whole fails every write, and that nothing is applied.
+func TestBatcherErrors(t *testing.T) {
+	b, store := newTestBatcher(t, 200*time.Millisecond, 2)
+	results := submitAll(b, []*VpLogCmd{{Op: CMDSET, Key: "a", Value: []byte("1")}, {Op: "BAD", Key: "b"}})
+	for i, r := range results {
+		if r.err != nil {
+			t.Fatalf("%d: %v", i, r.err)
+		}
+		if r.res == nil || r.res.Error == nil {
+			t.Errorf("%d: no error from a failed batch", i)
+		}
+	}
+	if v := valueOf(t, store, "a"); len(v) > 0 {
+		t.Errorf("write of a failed batch applied: %q", v)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := b.Submit(ctx, &VpLogCmd{Op: CMDSET, Key: "c"}, time.Second); err != context.Canceled {
+		t.Errorf("canceled write: %v", err)
+	}
+	b.s.raft.Shutdown().Error()
+	results = submitAll(b, []*VpLogCmd{{Op: CMDSET, Key: "d", Value: []byte("1")}, {Op: CMDSET, Key: "e", Value: []byte("1")}})
+	for i, r := range results {
+		if r.err != raft.ErrRaftShutdown {
+			t.Errorf("%d: %v, want the error of the log entry", i, r.err)
+		}
+	}
+}
+
+// TestBatcherSplit checks that writes which fit a transaction each, but not together, are split.
+func TestBatcherSplit(t *testing.T) {
+	b, store := newTestBatcher(t, time.Millisecond, 2)
+	n := int(store.db.MaxBatchCount()/2) + 1 // a data key and an audit record each
+	batch := make([]*pendingWrite, n)
+	for i := range batch {
+		cmd := &VpLogCmd{Op: CMDSET, Key: fmt.Sprint(i), Value: []byte("v")}
+		batch[i] = &pendingWrite{ctx: context.Background(), cmd: cmd, deadline: time.Now().Add(time.Minute), done: make(chan applyResult, 1)}
+	}
+	if store.CheckTxn(&VpLogCmd{Op: CMDBATCH, Batch: []VpLogCmd{*batch[0].cmd}}) != nil {
+		t.Fatal("a single write exceeds the limits")
+	}
+	b.commit(batch)
+	entries := make(map[uint64]bool)
+	for i, p := range batch {
+		r := <-p.done
+		if r.err != nil || r.res == nil || r.res.Error != nil {
+			t.Fatalf("%d: %v %+v", i, r.err, r.res)
+		}
+		entries[r.index] = true
+	}
+	if len(entries) < 2 {
+		t.Errorf("%d writes applied in %d entries", n, len(entries))
+	}
+	if v := valueOf(t, store, fmt.Sprint(n-1)); v != "v" {
+		t.Errorf("last write of the batch: %q", v)
+	}
+}
+
+// TestBatcherDeadlines checks that writes whose writer stopped waiting are left out of their batch.
+func TestBatcherDeadlines(t *testing.T) {
+	b, store := newTestBatcher(t, 100*time.Millisecond, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan error, 3)
+	submit := func(ctx context.Context, key string, timeout time.Duration) {
+		_, _, err := b.Submit(ctx, &VpLogCmd{Op: CMDSET, Key: key, Value: []byte("v")}, timeout)
+		results <- err
+	}
+	go submit(context.Background(), "short", 10*time.Millisecond)
+	go submit(ctx, "canceled", time.Minute)
+	go submit(context.Background(), "long", time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	errs := make(map[error]int)
+	for i := 0; i < 3; i++ {
+		errs[<-results]++
+	}
+	if errs[nil] != 1 || errs[ErrWriteTimeout] != 1 || errs[context.Canceled] != 1 {
+		t.Errorf("results %v", errs)
+	}
+	for key, want := range map[string]string{"short": "", "canceled": "", "long": "v"} {
+		if v := valueOf(t, store, key); v != want {
+			t.Errorf("%s: %q, want %q", key, v, want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	RKvBatchGet = "/kv/batch/get"
+	RKvBatchSet = "/kv/batch/set"
+	RKvBatchDel = "/kv/batch/del"
+	BulkMaxOps  = 10000
+)
+
+var (
+	ErrBulkEmpty    = errors.New("no operations")
+	ErrBulkTooLarge = fmt.Errorf("more than %d operations or %d bytes of values", BulkMaxOps, BatchMaxBytes)
+)
+
+// VpKv is one operation of a bulk request, and one result of a bulk get, where a nil Value
+// means the key was not found. Values are base64 encoded in JSON.
+type VpKv struct {
+	Key   string
+	Value []byte
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+func keysOfOps(ops []VpKv) []string {
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	return keys
+}
+
+/*
+	bulkOpsOf reads the operations of a bulk request: a JSON array of {"Key","Value"} objects
+	or one object per line (NDJSON) in the body, or repeated key parameters for GET requests.
+*/
+func bulkOpsOf(w http.ResponseWriter, req *http.Request) ([]VpKv, error) {
+	ops := make([]VpKv, 0)
+	if req.Method == Get {
+		req.ParseForm()
+		for _, key := range req.Form[PKey] {
+			ops = append(ops, VpKv{Key: key})
+		}
+	} else {
+		body, err := bodyOf(w, req)
+		if err != nil {
+			return nil, err
+		}
+		if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+			if err := json.Unmarshal(body, &ops); err != nil {
+				return nil, err
+			}
+		} else {
+			dec := json.NewDecoder(bytes.NewReader(body))
+			for {
+				op := VpKv{}
+				if err := dec.Decode(&op); err == io.EOF {
+					break
+				} else if err != nil {
+					return nil, err
+				}
+				ops = append(ops, op)
+			}
+		}
+	}
+	if len(ops) == 0 {
+		return nil, ErrBulkEmpty
+	}
+	size := 0
+	for _, op := range ops {
+		size += len(op.Key) + len(op.Value)
+	}
+	if len(ops) > BulkMaxOps || size > BatchMaxBytes {
+		return nil, ErrBulkTooLarge
+	}
+	return ops, nil
+}
+
+func bulkStatusOf(err error) int {
+	switch err {
+	case ErrBulkTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrAclDenied:
+		return http.StatusForbidden
+	case ErrAclNoToken, ErrAclNoSession:
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
+
+/* ==================================================================================
+                            Bulk operations
+================================================================================== */
+
+// GetDataOf reads the values of keys in a single transaction, nil for missing keys.
+func (b *BadgerStore) GetDataOf(keys []string) ([]VpKv, error) {
+	res := make([]VpKv, len(keys))
+	err := b.db.View(func(txn *badger.Txn) error {
+		for i, key := range keys {
+			res[i].Key = key
+			item, err := txn.Get(dataKeyOf([]byte(key)))
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if res[i].Value, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// RaftBulk commits a set or a delete of every key of ops as a single BATCH log entry.
+func (s *Server) RaftBulk(ctx context.Context, op string, ops []VpKv, wr *VpWrite, o *VpOrigin) error {
+	if log.IsDebug() {
+		log.Debug("Log bulk", "op", op, "count", len(ops))
+	}
+	_, span := StartSpan(ctx, "raft.bulk", SpanInternal)
+	defer span.End()
+	span.SetAttr("vephar.op", op)
+	span.SetAttr("vephar.batch_size", len(ops))
+	cmd := &VpLogCmd{Op: CMDBATCH, Batch: make([]VpLogCmd, len(ops)), Id: wr.Id, Origin: o}
+	for i, kv := range ops {
+		cmd.Batch[i] = VpLogCmd{Op: op, Key: kv.Key, Origin: o, Trace: span.TraceParent()}
+		if op == CMDSET {
+			cmd.Batch[i].Value = kv.Value
+		}
+	}
+	err := s.raftSubmit(ctx, cmd, wr)
+	span.SetError(err)
+	return err
+}
+
+/* ==================================================================================
+                            Request methods
+================================================================================== */
+
+// BulkGetRequest reads many keys at once, with a consistent view, as JSON or as NDJSON.
+func (h *WebHandler) BulkGetRequest(w http.ResponseWriter, req *http.Request) {
+	ops, err := bulkOpsOf(w, req)
+	if err == nil {
+		err = h.keysAllowed(req, keysOfOps(ops), AclRead)
+	}
+	if err != nil {
+		onError(w, err, bulkStatusOf(err))
+		return
+	}
+	res, err := h.s.store.GetDataOf(keysOfOps(ops))
+	if err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else if req.URL.Query().Get(PFormat) == "ndjson" || strings.Contains(req.Header.Get("Accept"), VNdJson) {
+		w.Header().Set(HContentType, VNdJson)
+		enc := json.NewEncoder(w)
+		for i := range res {
+			enc.Encode(&res[i])
+		}
+	} else {
+		onSuccess(w, &VpResponse{Data: res}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) bulkWrite(w http.ResponseWriter, req *http.Request, op string) {
+	if h.leaderOnly() {
+		h.forwardToLeader(w, req)
+		return
+	}
+	wr, ctx, cancel, err := h.writeOf(req)
+	if err != nil {
+		onError(w, err, http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	ops, err := bulkOpsOf(w, req)
+	if err == nil {
+		err = h.keysAllowed(req, keysOfOps(ops), AclWrite)
+	}
+	if err != nil {
+		onError(w, err, bulkStatusOf(err))
+	} else if !h.admit(w, req, len(ops)) {
+		return
+	} else if err := h.s.RaftBulk(ctx, op, ops, wr, h.originOf(req)); err != nil {
+		onWriteError(w, err)
+	} else {
+		onWritten(w, req, wr, keysOfOps(ops))
+	}
+}
+
+// BulkSetRequest sets many keys atomically, in one log entry.
+func (h *WebHandler) BulkSetRequest(w http.ResponseWriter, req *http.Request) {
+	h.bulkWrite(w, req, CMDSET)
+}
+
+// BulkDeleteRequest deletes many keys atomically, in one log entry.
+func (h *WebHandler) BulkDeleteRequest(w http.ResponseWriter, req *http.Request) {
+	h.bulkWrite(w, req, CMDDEL)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	RHealthLive   = "/health/live"
+	RHealthReady  = "/health/ready"
+	RHealthLeader = "/health/leader"
+)
+
+type VpCheck struct {
+	Name   string
+	Ok     bool
+	Detail string
+}
+
+type VpHealth struct {
+	Healthy bool
+	Checks  []VpCheck
+}
+
+func (hl *VpHealth) check(name string, ok bool, detail string) {
+	hl.Checks = append(hl.Checks, VpCheck{Name: name, Ok: ok, Detail: detail})
+	hl.Healthy = hl.Healthy && ok
+}
+
+// BeginShutdown makes the node report itself as not ready while it drains.
+func (s *Server) BeginShutdown() {
+	atomic.StoreInt32(&s.stopping, 1)
+}
+
+// Readiness checks whether this node can serve consistent requests: it is not shutting down,
+// its store is open, it knows the leader, and it has applied the log up to maxLag entries
+// behind its commit index. With leader set, the node must also be the leader.
+func (s *Server) Readiness(maxLag uint64, leader bool) *VpHealth {
+	hl := &VpHealth{Healthy: true}
+	hl.check("shutdown", atomic.LoadInt32(&s.stopping) == 0, "")
+	if s.raft == nil || s.store == nil {
+		hl.check("raft", false, "not started")
+		return hl
+	}
+	hl.check("store", s.store.IsOpen(), "")
+	leaderAddr := s.raft.Leader()
+	hl.check("leader", len(leaderAddr) > 0, string(leaderAddr))
+	commitIdx, _ := strconv.ParseUint(s.raft.Stats()["commit_index"], 10, 64)
+	appliedIdx := s.raft.AppliedIndex()
+	hl.check("applied", appliedIdx+maxLag >= commitIdx, fmt.Sprintf("applied=%d commit=%d", appliedIdx, commitIdx))
+	if leader {
+		hl.check("isLeader", s.raft.State() == raft.Leader, s.raft.State().String())
+	}
+	return hl
+}
+
+/* ==================================================================================
+                            Request methods
+================================================================================== */
+
+func (h *WebHandler) LiveRequest(w http.ResponseWriter, req *http.Request) {
+	onSuccess(w, &VpResponse{Data: &VpHealth{Healthy: true}}, http.StatusOK)
+}
+
+func (h *WebHandler) healthResponse(w http.ResponseWriter, hl *VpHealth) {
+	if hl.Healthy {
+		onSuccess(w, &VpResponse{Data: hl}, http.StatusOK)
+	} else {
+		onSuccess(w, &VpResponse{Data: hl, Error: "not ready"}, http.StatusServiceUnavailable)
+	}
+}
+
+func (h *WebHandler) ReadyRequest(w http.ResponseWriter, req *http.Request) {
+	h.healthResponse(w, h.s.Readiness(h.readyMaxLag, false))
+}
+
+func (h *WebHandler) LeaderRequest(w http.ResponseWriter, req *http.Request) {
+	h.healthResponse(w, h.s.Readiness(h.readyMaxLag, true))
+}
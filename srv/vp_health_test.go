@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestHealth checks liveness and readiness on the leader and a follower, and while a node shuts down.
+func TestHealth(t *testing.T) {
+	nodes, _ := newTestHttpCluster(t, 2)
+	leader, follower := nodes[0], nodes[1]
+	for _, c := range []struct {
+		s    *Server
+		uri  string
+		want int
+	}{
+		{leader, RHealthLive, http.StatusOK},
+		{leader, RHealthReady, http.StatusOK},
+		{leader, RHealthLeader, http.StatusOK},
+		{follower, RHealthLive, http.StatusOK},
+		{follower, RHealthReady, http.StatusOK},
+		{follower, RHealthLeader, http.StatusServiceUnavailable},
+	} {
+		if code := getFrom(t, c.s, c.uri); code != c.want {
+			t.Errorf("%s on %s: %d, want %d", c.uri, c.s.peerId, code, c.want)
+		}
+	}
+	follower.BeginShutdown()
+	if code := getFrom(t, follower, RHealthReady); code != http.StatusServiceUnavailable {
+		t.Errorf("ready while shutting down: %d", code)
+	}
+	if code := getFrom(t, follower, RHealthLive); code != http.StatusOK {
+		t.Errorf("not live while shutting down: %d", code)
+	}
+	if hl := NewServer("", testPeerId, nil, false).Readiness(0, false); hl.Healthy {
+		t.Errorf("ready before start: %+v", hl)
+	}
+}
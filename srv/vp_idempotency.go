@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	HIdempotencyKey     = "Idempotency-Key"
+	HIdempotentReplayed = "Idempotent-Replayed"
+	IdempotencyWindow   = time.Hour // must be the same on every node, since Apply depends on it
+	IdempotencyPruneMax = 128       // expired records removed per applied entry
+)
+
+var (
+	ErrIdempotencyKey       = errors.New("invalid " + HIdempotencyKey)
+	ErrIdempotencyKeyReused = errors.New(HIdempotencyKey + " already used for a different request")
+)
+
+/*
+	VpApplied records a write applied with an idempotency key, so that the same write applied
+	again within IdempotencyWindow is answered without being applied twice. Time is the append
+	time of its log entry, as seen by the leader, which keeps expiry identical on every node.
+	Hash identifies the request, so that the key reused for a different one is refused.
+*/
+type VpApplied struct {
+	Index     uint64
+	Time      int64
+	Op        string
+	Key       string
+	Principal string
+	Hash      string
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+func idmKeyOf(id string) []byte {
+	key := fmt.Sprintf("%s%s", dbIdmPrefix, hex.EncodeToString([]byte(id)))
+	if log.IsTrace() {
+		log.Trace("badger key", "idm", key)
+	}
+	return []byte(key)
+}
+
+// idtKeyOf orders the records by time, for pruning.
+func idtKeyOf(t int64, id string) []byte {
+	return []byte(fmt.Sprintf("%s%016x%s", dbIdtPrefix, uint64(t), hex.EncodeToString([]byte(id))))
+}
+
+func principalOfOrigin(o *VpOrigin) string {
+	if o == nil {
+		return ""
+	}
+	return o.Principal
+}
+
+// idempotencyKeyOf returns the idempotency key of a write request, if any.
+func idempotencyKeyOf(req *http.Request) (string, error) {
+	id := req.Header.Get(HIdempotencyKey)
+	if len(id) > 0 && !validRequestId(id) {
+		return "", ErrIdempotencyKey
+	}
+	return id, nil
+}
+
+// setReplayed flags the response to a write which was answered with the outcome of an earlier one.
+func setReplayed(w http.ResponseWriter, req *http.Request) {
+	if accessOf(req).Replayed {
+		w.Header().Set(HIdempotentReplayed, "true")
+	}
+}
+
+/*
+	payloadHashOf hashes a command as sent by the client: everything but its origin and trace,
+	which differ between retries of the same request, e.g. sent to another node. The commands of
+	a batch are hashed likewise.
+*/
+func payloadHashOf(cmd *VpLogCmd) string {
+	c := *cmd
+	c.Origin, c.Trace, c.Batch = nil, "", make([]VpLogCmd, len(cmd.Batch))
+	for i, b := range cmd.Batch {
+		b.Origin, b.Trace = nil, ""
+		c.Batch[i] = b
+	}
+	raw, _ := json.Marshal(&c) // struct fields encode in a fixed order
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// response answers a repeated write with the outcome of the first one.
+func (a *VpApplied) response(cmd *VpLogCmd) *VpRpcResponse {
+	if a.Hash != payloadHashOf(cmd) || a.Principal != principalOfOrigin(cmd.Origin) {
+		return &VpRpcResponse{Error: ErrIdempotencyKeyReused}
+	}
+	return &VpRpcResponse{Replayed: true}
+}
+
+/* ==================================================================================
+                            Applied writes
+================================================================================== */
+
+// appliedOf finds the record of an earlier write with the idempotency key of cmd, unless expired at now.
+func appliedOf(txn *badger.Txn, cmd *VpLogCmd, now time.Time) (*VpApplied, error) {
+	if len(cmd.Id) == 0 {
+		return nil, nil
+	}
+	item, err := txn.Get(idmKeyOf(cmd.Id))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	a := VpApplied{}
+	if err := item.Value(func(v []byte) error { return json.Unmarshal(v, &a) }); err != nil {
+		return nil, err
+	}
+	if now.Sub(time.Unix(0, a.Time)) > IdempotencyWindow {
+		return nil, nil
+	}
+	return &a, nil
+}
+
+func recordApplied(txn *badger.Txn, index uint64, cmd *VpLogCmd, now time.Time) error {
+	a := VpApplied{
+		Index: index, Time: now.UnixNano(), Op: cmd.Op, Key: cmd.Key,
+		Principal: principalOfOrigin(cmd.Origin), Hash: payloadHashOf(cmd),
+	}
+	raw, err := json.Marshal(&a)
+	if err != nil {
+		return err
+	}
+	if err := txn.Set(idmKeyOf(cmd.Id), raw); err != nil {
+		return err
+	}
+	return txn.Set(idtKeyOf(a.Time, cmd.Id), []byte(cmd.Id))
+}
+
+// pruneApplied removes up to IdempotencyPruneMax records which expired at now.
+func pruneApplied(txn *badger.Txn, now time.Time) error {
+	expired := make([][]byte, 0)
+	until := idtKeyOf(now.Add(-IdempotencyWindow).UnixNano(), "")
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(dbIdtPrefix); it.ValidForPrefix(dbIdtPrefix) && len(expired) < IdempotencyPruneMax; it.Next() {
+		if string(it.Item().Key()) >= string(until) {
+			break
+		}
+		expired = append(expired, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+	for _, key := range expired {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		id, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if a, err := appliedOf(txn, &VpLogCmd{Id: string(id)}, now); err != nil {
+			return err
+		} else if a == nil { // not renewed by a later write with the same key
+			if err := txn.Delete(idmKeyOf(string(id))); err != nil {
+				return err
+			}
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+func countOf(t *testing.T, store *BadgerStore, prefix []byte) int {
+	n := 0
+	err := store.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func valueOf(t *testing.T, store *BadgerStore, key string) string {
+	data, err := store.GetData([]byte(key))
+	if err != nil && err != ErrKeyNotFound {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	store := newTestStore(t)
+	t0 := time.Now()
+	alice, bob := &VpOrigin{Principal: "alice"}, &VpOrigin{Principal: "bob"}
+	for i, c := range []struct {
+		cmd      VpLogCmd
+		at       time.Duration
+		replayed bool
+		err      error
+		value    string
+	}{
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("1"), Id: "x", Origin: alice}, 0, false, nil, "1"},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("1"), Id: "x", Origin: alice, Trace: "retry"}, time.Minute, true, nil, "1"},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("2"), Id: "x", Origin: alice}, time.Minute, false, ErrIdempotencyKeyReused, "1"},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("3"), Origin: alice}, 2 * time.Minute, false, nil, "3"},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("1"), Id: "x", Origin: alice}, 3 * time.Minute, true, nil, "3"},
+		{VpLogCmd{Op: CMDSET, Key: "b", Value: []byte("1"), Id: "x", Origin: alice}, 4 * time.Minute, false, ErrIdempotencyKeyReused, "3"},
+		{VpLogCmd{Op: CMDDEL, Key: "a", Id: "x", Origin: alice}, 5 * time.Minute, false, ErrIdempotencyKeyReused, "3"},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("1"), Id: "x", Origin: bob}, 6 * time.Minute, false, ErrIdempotencyKeyReused, "3"},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("4"), Id: "x", Origin: alice}, IdempotencyWindow + time.Second, false, nil, "4"},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("4"), Id: "x", Origin: alice}, IdempotencyWindow + time.Minute, true, nil, "4"},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("5"), Id: "x", Origin: alice}, IdempotencyWindow + 2*time.Minute, false, ErrIdempotencyKeyReused, "4"},
+	} {
+		res := applyCmdAt(t, store, uint64(i+1), &c.cmd, t0.Add(c.at))
+		if res.Replayed != c.replayed || res.Error != c.err {
+			t.Errorf("%d: replayed %v, error %v", i, res.Replayed, res.Error)
+		}
+		if v := valueOf(t, store, "a"); v != c.value {
+			t.Errorf("%d: value %q, want %q", i, v, c.value)
+		}
+	}
+	if status := writeStatusOf(ErrIdempotencyKeyReused); status != http.StatusUnprocessableEntity {
+		t.Errorf("status %d, want 422", status)
+	}
+}
+
+// TestIdempotentBatch checks idempotency keys repeated within a batch, and the keys of batches themselves.
+func TestIdempotentBatch(t *testing.T) {
+	store := newTestStore(t)
+	batch := &VpLogCmd{Op: CMDBATCH, Id: "batch", Batch: []VpLogCmd{
+		{Op: CMDSET, Key: "a", Value: []byte("1"), Id: "x"},
+		{Op: CMDSET, Key: "a", Value: []byte("1"), Id: "x"},
+		{Op: CMDSET, Key: "a", Value: []byte("2"), Id: "x"},
+		{Op: CMDSET, Key: "b", Value: []byte("1"), Id: "y"},
+	}}
+	res := applyCmd(t, store, 1, batch)
+	if res.Error != nil || len(res.Batch) != 4 || res.Batch[0].Replayed || !res.Batch[1].Replayed || res.Batch[3].Replayed {
+		t.Fatalf("first batch: %+v", res)
+	}
+	if res.Batch[2].Error != ErrIdempotencyKeyReused {
+		t.Errorf("key reused within a batch for another value: %+v", res.Batch[2])
+	}
+	if v := valueOf(t, store, "a"); v != "1" {
+		t.Errorf("value %q, the repeated write must not be applied", v)
+	}
+	if res := applyCmd(t, store, 2, batch); !res.Replayed {
+		t.Errorf("batch applied twice: %+v", res)
+	}
+	if res := applyCmd(t, store, 3, &VpLogCmd{Op: CMDSET, Key: "b", Value: []byte("1"), Id: "y"}); !res.Replayed {
+		t.Errorf("write of a batch applied again on its own: %+v", res)
+	}
+	// a bulk request reusing the key with another body is refused, not answered as replayed
+	other := &VpLogCmd{Op: CMDBATCH, Id: "batch", Batch: []VpLogCmd{{Op: CMDSET, Key: "c", Value: []byte("1")}}}
+	if res := applyCmd(t, store, 4, other); res.Error != ErrIdempotencyKeyReused {
+		t.Errorf("batch key reused for another body: %+v", res)
+	}
+	if v := valueOf(t, store, "c"); len(v) > 0 {
+		t.Errorf("batch reusing a key applied: %q", v)
+	}
+}
+
+// TestPruneApplied checks that expired records are removed, unless renewed by a later write.
+func TestPruneApplied(t *testing.T) {
+	store := newTestStore(t)
+	t0 := time.Now()
+	applyCmdAt(t, store, 1, &VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("1"), Id: "x"}, t0)
+	applyCmdAt(t, store, 2, &VpLogCmd{Op: CMDSET, Key: "b", Value: []byte("1"), Id: "y"}, t0)
+	if n := countOf(t, store, dbIdmPrefix); n != 2 {
+		t.Fatalf("%d records, want 2", n)
+	}
+	// x is applied again once expired, which renews its record
+	applyCmdAt(t, store, 3, &VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("2"), Id: "x"}, t0.Add(IdempotencyWindow+time.Second))
+	if n := countOf(t, store, dbIdmPrefix); n != 1 {
+		t.Errorf("%d records once y expired, want 1", n)
+	}
+	if n := countOf(t, store, dbIdtPrefix); n != 1 {
+		t.Errorf("%d expiry entries, want 1", n)
+	}
+	applyCmdAt(t, store, 4, &VpLogCmd{Op: CMDSET, Key: "c", Value: []byte("1")}, t0.Add(2*IdempotencyWindow+time.Minute))
+	if n := countOf(t, store, dbIdmPrefix) + countOf(t, store, dbIdtPrefix); n != 0 {
+		t.Errorf("%d records left once all expired", n)
+	}
+}
+
+// TestPruneAppliedMax checks that each entry prunes at most IdempotencyPruneMax records.
+func TestPruneAppliedMax(t *testing.T) {
+	store := newTestStore(t)
+	t0 := time.Now()
+	n := IdempotencyPruneMax + 10
+	for i := 0; i < n; i++ {
+		applyCmdAt(t, store, uint64(i+1), &VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("1"), Id: fmt.Sprint("id-", i)}, t0)
+	}
+	later := t0.Add(IdempotencyWindow + time.Second)
+	applyCmdAt(t, store, uint64(n+1), &VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("2")}, later)
+	if left := countOf(t, store, dbIdmPrefix); left != n-IdempotencyPruneMax {
+		t.Errorf("%d records left, want %d", left, n-IdempotencyPruneMax)
+	}
+	applyCmdAt(t, store, uint64(n+2), &VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("3")}, later)
+	if left := countOf(t, store, dbIdmPrefix); left != 0 {
+		t.Errorf("%d records left, want 0", left)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	RMetrics      = "/metrics"
+	MetricsPrefix = "vephar"
+	VTextMetrics  = "text/plain; version=0.0.4"
+)
+
+type promKind int
+
+const (
+	promCounter promKind = iota
+	promGauge
+	promSummary
+)
+
+type promSeries struct {
+	kind   promKind
+	name   string
+	labels string
+	value  float64 // counter or gauge value, sum for summaries
+	count  uint64
+}
+
+/*
+	PromSink is a go-metrics sink which keeps cumulative values in memory and renders them
+	in the Prometheus text format. hashicorp/raft reports through the global go-metrics
+	instance, so installing it globally exposes raft metrics next to vephar's own.
+	Samples become summaries without quantiles, i.e. a _sum (in milliseconds for timers)
+	and a _count.
+*/
+type PromSink struct {
+	mu     sync.Mutex
+	series map[string]*promSeries
+}
+
+func NewPromSink() *PromSink {
+	return &PromSink{series: make(map[string]*promSeries)}
+}
+
+// InitMetrics installs a PromSink as the global go-metrics sink.
+func InitMetrics() (*PromSink, error) {
+	sink := NewPromSink()
+	cfg := metrics.DefaultConfig(MetricsPrefix)
+	cfg.EnableHostname = false
+	cfg.TimerGranularity = time.Millisecond
+	if _, err := metrics.NewGlobal(cfg, sink); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+func promName(key []string) string {
+	name := strings.Join(key, "_")
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func promLabels(labels []metrics.Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(l.Value)
+		parts[i] = fmt.Sprintf(`%s="%s"`, promName([]string{l.Name}), v)
+	}
+	sort.Strings(parts)
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (p *PromSink) update(kind promKind, key []string, labels []metrics.Label, fn func(s *promSeries)) {
+	name, lbl := promName(key), promLabels(labels)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.series[name+lbl]
+	if !ok {
+		s = &promSeries{kind: kind, name: name, labels: lbl}
+		p.series[name+lbl] = s
+	}
+	fn(s)
+}
+
+/* ==================================================================================
+                            metrics.MetricSink
+================================================================================== */
+
+func (p *PromSink) SetGauge(key []string, val float32) {
+	p.SetGaugeWithLabels(key, val, nil)
+}
+
+func (p *PromSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	p.update(promGauge, key, labels, func(s *promSeries) { s.value = float64(val) })
+}
+
+func (p *PromSink) EmitKey(key []string, val float32) {
+	p.SetGaugeWithLabels(key, val, nil)
+}
+
+func (p *PromSink) IncrCounter(key []string, val float32) {
+	p.IncrCounterWithLabels(key, val, nil)
+}
+
+func (p *PromSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	p.update(promCounter, key, labels, func(s *promSeries) { s.value += float64(val) })
+}
+
+func (p *PromSink) AddSample(key []string, val float32) {
+	p.AddSampleWithLabels(key, val, nil)
+}
+
+func (p *PromSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	p.update(promSummary, key, labels, func(s *promSeries) {
+		s.value += float64(val)
+		s.count++
+	})
+}
+
+// Render writes every series in the Prometheus text exposition format.
+func (p *PromSink) Render() []byte {
+	p.mu.Lock()
+	all := make([]promSeries, 0, len(p.series))
+	for _, s := range p.series {
+		all = append(all, *s)
+	}
+	p.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].name != all[j].name {
+			return all[i].name < all[j].name
+		}
+		return all[i].labels < all[j].labels
+	})
+	var buf bytes.Buffer
+	for i, s := range all {
+		if i == 0 || all[i-1].name != s.name {
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", s.name, []string{"counter", "gauge", "summary"}[s.kind])
+		}
+		if s.kind == promSummary {
+			fmt.Fprintf(&buf, "%s_sum%s %g\n", s.name, s.labels, s.value)
+			fmt.Fprintf(&buf, "%s_count%s %d\n", s.name, s.labels, s.count)
+		} else {
+			fmt.Fprintf(&buf, "%s%s %g\n", s.name, s.labels, s.value)
+		}
+	}
+	return buf.Bytes()
+}
+
+/* ==================================================================================
+                            HTTP instrumentation
+================================================================================== */
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += n
+	return n, err
+}
+
+// Instrument counts the requests of a route by method and status code, and measures their latency.
+func Instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		labels := []metrics.Label{{Name: "route", Value: route}, {Name: "method", Value: req.Method}}
+		metrics.MeasureSinceWithLabels([]string{"http", "request", "duration"}, start, labels)
+		labels = append(labels, metrics.Label{Name: "code", Value: fmt.Sprint(sw.status)})
+		metrics.IncrCounterWithLabels([]string{"http", "requests"}, 1, labels)
+	}
+}
+
+func (h *WebHandler) MetricsRequest(w http.ResponseWriter, req *http.Request) {
+	if h.s.metrics == nil {
+		onError(w, errors.New("metrics are not initialized"), http.StatusServiceUnavailable)
+		return
+	}
+	lsm, vlog := h.s.store.Size()
+	metrics.SetGauge([]string{"badger", "lsm", "bytes"}, float32(lsm))
+	metrics.SetGauge([]string{"badger", "vlog", "bytes"}, float32(vlog))
+	metrics.SetGauge([]string{"kv", "keys"}, float32(h.s.store.KeyCount()))
+	metrics.SetGauge([]string{"raft", "applied", "index"}, float32(h.s.raft.AppliedIndex()))
+	metrics.SetGauge([]string{"raft", "last", "index"}, float32(h.s.raft.LastIndex()))
+	writeFile(w, h.s.metrics.Render(), VTextMetrics)
+}
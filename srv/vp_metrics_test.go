@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/armon/go-metrics"
+)
+
+func TestPromRender(t *testing.T) {
+	p := NewPromSink()
+	p.IncrCounterWithLabels([]string{"http", "requests"}, 1, []metrics.Label{{Name: "route", Value: "/a"}, {Name: "code", Value: "200"}})
+	p.IncrCounterWithLabels([]string{"http", "requests"}, 2, []metrics.Label{{Name: "code", Value: "200"}, {Name: "route", Value: "/a"}})
+	p.IncrCounterWithLabels([]string{"http", "requests"}, 1, []metrics.Label{{Name: "route", Value: "\"b\"\n"}})
+	p.SetGauge([]string{"raft", "state.leader"}, 1)
+	p.SetGauge([]string{"raft", "state.leader"}, 0)
+	p.AddSample([]string{"raft", "apply"}, 1.5)
+	p.AddSample([]string{"raft", "apply"}, 2.5)
+	want := `# TYPE http_requests counter
+http_requests{code="200",route="/a"} 3
+http_requests{route="\"b\"\n"} 1
+# TYPE raft_apply summary
+raft_apply_sum 4
+raft_apply_count 2
+# TYPE raft_state_leader gauge
+raft_state_leader 0
+`
+	if got := string(p.Render()); got != want {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestMetricsRequest checks that requests are counted by route, and that the node's gauges are exposed.
+func TestMetricsRequest(t *testing.T) {
+	sink, err := InitMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.NewGlobal(metrics.DefaultConfig("test"), &metrics.BlackholeSink{})
+	store := newTestStore(t)
+	s := &Server{peerId: testPeerId, store: store, raft: newTestLeader(t, store), metrics: sink}
+	applyCmd(t, store, 100, &VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("1")})
+	h := NewWebHandler(s, 0, 0)
+	Instrument(RV1Kv, h.V1KvRequest)(httptest.NewRecorder(), httptest.NewRequest(Get, RV1Kv+"a", nil))
+	w := httptest.NewRecorder()
+	h.MetricsRequest(w, httptest.NewRequest(Get, RMetrics, nil))
+	if w.Code != http.StatusOK || w.Header().Get(HContentType) != VTextMetrics {
+		t.Fatalf("%d, %s", w.Code, w.Header().Get(HContentType))
+	}
+	for _, line := range []string{
+		`vephar_http_requests{code="200",method="GET",route="/v1/kv/"} 1`,
+		`vephar_http_request_duration_count{method="GET",route="/v1/kv/"} 1`,
+		"vephar_kv_keys 1",
+		"# TYPE vephar_raft_last_index gauge",
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("no %s in\n%s", line, w.Body)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROpenApi       = "/openapi.json"
+	OpenApiVersion = "3.0.3"
+	ApiRefPrefix   = "#/components/"
+)
+
+// apiSchema is a JSON schema, or any other object of the OpenAPI document.
+type apiSchema map[string]interface{}
+
+// apiSchemas collects the schemas of the named Vp types used by the document, as its components.
+type apiSchemas map[string]interface{}
+
+/*
+	apiOp describes one method of a route. The schemas of request bodies and responses are
+	derived from sample values of the Go types read and written by the handlers, so that they
+	follow changes to these types. Successful responses are VpResponses with data as Data,
+	unless content is set.
+*/
+type apiOp struct {
+	id      string
+	summary string
+	params  []string               // names of components/parameters
+	body    map[string]interface{} // sample value by content type, nil for raw bytes
+	status  int
+	data    interface{}
+	content string         // content type of successful responses which are not VpResponses
+	stream  interface{}    // sample line of NDJSON responses, when supported
+	more    map[int]string // other statuses, with their description
+}
+
+var (
+	openApiOnce sync.Once
+	openApiJson []byte
+	openApiErr  error
+	// apiRaftStats stands for the map returned by RaftStats, which is described by hand.
+	apiRaftStats = apiSchema{"$ref": ApiRefPrefix + "schemas/VpRaftStats"}
+)
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+// apiPathOf is the OpenAPI path of a route, where routes ending with / take a key.
+func apiPathOf(route string) string {
+	if strings.HasSuffix(route, "/") {
+		return route + "{" + PKey + "}"
+	}
+	return route
+}
+
+func apiParam(in string, name string, schema apiSchema, required bool, description string) apiSchema {
+	return apiSchema{"in": in, "name": name, "schema": schema, "required": required, "description": description}
+}
+
+func apiString(format string) apiSchema {
+	if len(format) == 0 {
+		return apiSchema{"type": "string"}
+	}
+	return apiSchema{"type": "string", "format": format}
+}
+
+// writeOp adds the parameters and statuses common to every write to op.
+func writeOp(op apiOp) apiOp {
+	op.params = append(op.params, HIdempotencyKey, PTimeout, PAsync)
+	if op.more == nil {
+		op.more = make(map[int]string)
+	}
+	op.more[http.StatusAccepted] = "Appended to the log of the leader but not applied yet, with async"
+	op.more[http.StatusUnprocessableEntity] = HIdempotencyKey + " already used for a different write"
+	op.more[http.StatusTooManyRequests] = "The leader is overloaded or the client exceeded its rate, retry after Retry-After"
+	op.more[http.StatusGatewayTimeout] = "Timed out waiting for the write to be applied, it may still be"
+	return op
+}
+
+// of returns the schema of the JSON encoding of values like v, with named Vp structs as components.
+func (c apiSchemas) of(v interface{}) apiSchema {
+	if s, ok := v.(apiSchema); ok {
+		return s
+	}
+	return c.ofType(reflect.TypeOf(v))
+}
+
+func (c apiSchemas) ofType(t reflect.Type) apiSchema {
+	if t == nil {
+		return apiSchema{}
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return apiString("date-time")
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if !strings.HasPrefix(t.Name(), "Vp") {
+			return c.objectOf(t)
+		}
+		if _, ok := c[t.Name()]; !ok {
+			c[t.Name()] = apiSchema{} // for recursive types
+			c[t.Name()] = c.objectOf(t)
+		}
+		return apiSchema{"$ref": ApiRefPrefix + "schemas/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return apiString("byte") // base64 encoded
+		}
+		return apiSchema{"type": "array", "items": c.ofType(t.Elem())}
+	case reflect.Map:
+		return apiSchema{"type": "object", "additionalProperties": c.ofType(t.Elem())}
+	case reflect.String:
+		return apiString("")
+	case reflect.Bool:
+		return apiSchema{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64, reflect.Int, reflect.Uint:
+		return apiSchema{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return apiSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return apiSchema{"type": "number"}
+	}
+	return apiSchema{} // interface{}, any value
+}
+
+func (c apiSchemas) objectOf(t reflect.Type) apiSchema {
+	props := apiSchema{}
+	c.fieldsOf(t, props)
+	return apiSchema{"type": "object", "properties": props}
+}
+
+// fieldsOf adds the properties of the exported fields of a struct, like encoding/json.
+func (c apiSchemas) fieldsOf(t reflect.Type, props apiSchema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && len(name) == 0 && f.Type.Kind() == reflect.Struct {
+			c.fieldsOf(f.Type, props) // embedded fields are flattened
+			continue
+		}
+		if len(f.PkgPath) > 0 || name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		props[name] = c.ofType(f.Type)
+	}
+}
+
+// responseOf is the schema of a VpResponse holding values like data.
+func (c apiSchemas) responseOf(data interface{}) apiSchema {
+	res := c.of(VpResponse{})
+	if data == nil {
+		return res
+	}
+	return apiSchema{"allOf": []apiSchema{res, {"type": "object", "properties": apiSchema{"Data": c.of(data)}}}}
+}
+
+func (c apiSchemas) bodyOf(body map[string]interface{}) apiSchema {
+	content := apiSchema{}
+	for ct, v := range body {
+		schema := apiString("binary")
+		if ct == VMultiPartFormData {
+			schema = apiSchema{"type": "object", "properties": apiSchema{PValue: schema}}
+		} else if v != nil {
+			schema = c.of(v)
+		}
+		content[ct] = apiSchema{"schema": schema}
+	}
+	return apiSchema{"required": true, "content": content}
+}
+
+func (c apiSchemas) operationOf(route string, method string, op *apiOp) apiSchema {
+	content := apiSchema{}
+	if len(op.content) > 0 {
+		schema := apiString("binary")
+		if strings.HasPrefix(op.content, "text/") {
+			schema = apiString("")
+		}
+		content[op.content] = apiSchema{"schema": schema}
+	} else {
+		content[VApplicationJson] = apiSchema{"schema": c.responseOf(op.data)}
+	}
+	if op.stream != nil {
+		content[VNdJson] = apiSchema{"schema": c.of(op.stream)}
+	}
+	ok := apiSchema{"description": http.StatusText(op.status)}
+	if method != Head && op.status < http.StatusMultipleChoices {
+		ok["content"] = content
+	}
+	responses := apiSchema{strconv.Itoa(op.status): ok, "default": apiSchema{"$ref": ApiRefPrefix + "responses/Error"}}
+	for status, description := range op.more {
+		res := apiSchema{"description": description}
+		if status >= http.StatusBadRequest {
+			res["content"] = apiSchema{VApplicationJson: apiSchema{"schema": c.responseOf(nil)}}
+		} else if status != http.StatusNotModified && method != Head {
+			res["content"] = content
+		}
+		responses[strconv.Itoa(status)] = res
+	}
+	params := make([]apiSchema, len(op.params))
+	for i, name := range op.params {
+		params[i] = apiSchema{"$ref": ApiRefPrefix + "parameters/" + name}
+	}
+	o := apiSchema{
+		"operationId": op.id,
+		"summary":     op.summary,
+		"tags":        []string{strings.Split(route, "/")[1]},
+		"parameters":  params,
+		"responses":   responses,
+	}
+	if op.body != nil {
+		o["requestBody"] = c.bodyOf(op.body)
+	}
+	return o
+}
+
+/* ==================================================================================
+                            OpenAPI document
+================================================================================== */
+
+// apiParams are the query parameters and headers of the routes, by component name.
+func apiParams() apiSchema {
+	integer := apiSchema{"type": "integer"}
+	boolean := apiSchema{"type": "boolean"}
+	return apiSchema{
+		PKey:            apiParam("query", PKey, apiString(""), true, "Key"),
+		"keys":          apiParam("query", PKey, apiSchema{"type": "array", "items": apiString("")}, false, "Keys to read, repeated, instead of a body"),
+		"v1Key":         apiParam("path", PKey, apiString(""), true, "Key, URL encoded so that it can hold any byte"),
+		PValue:          apiParam("query", PValue, apiString(""), false, "Value, unless sent as the request body"),
+		PPrefix:         apiParam("query", PPrefix, apiString(""), false, "Key prefix"),
+		POffset:         apiParam("query", POffset, apiString(""), false, "Key to start from, NextKey of the previous page"),
+		PPageSize:       apiParam("query", PPageSize, integer, true, "Maximum number of keys, 0 for all of them"),
+		PPeerId:         apiParam("query", PPeerId, apiString(""), true, "Peer, as raftHost:raftPort:httpPort"),
+		"anyPeerId":     apiParam("query", PPeerId, apiString(""), false, "Peer, as raftHost:raftPort:httpPort, or raft's pick when omitted"),
+		PNonVoter:       apiParam("query", PNonVoter, boolean, false, "Join as a non-voter"),
+		PName:           apiParam("query", PName, apiString(""), true, "Name"),
+		PAccessor:       apiParam("query", PAccessor, apiString(""), true, "Accessor of the token"),
+		PFrom:           apiParam("query", PFrom, apiString("date-time"), false, "Oldest entry, RFC 3339"),
+		PTo:             apiParam("query", PTo, apiString("date-time"), false, "Newest entry, RFC 3339"),
+		PPrincipal:      apiParam("query", PPrincipal, apiString(""), false, "Principal which made the changes"),
+		PLimit:          apiParam("query", PLimit, integer, false, "Maximum number of entries"),
+		PFormat:         apiParam("query", PFormat, apiSchema{"type": "string", "enum": []string{"json", "ndjson"}}, false, "Response format"),
+		PTimeout:        apiParam("query", PTimeout, apiString(""), false, "How long to wait for the write to be applied, as a Go duration"),
+		PAsync:          apiParam("query", PAsync, boolean, false, "Only wait for the write to be appended to the leader's log"),
+		"state":         apiParam("query", "state", apiString(""), true, "OIDC login state"),
+		"code":          apiParam("query", "code", apiString(""), true, "OIDC authorization code"),
+		HIdempotencyKey: apiParam("header", HIdempotencyKey, apiString(""), false, "Makes retries of the same write apply it once"),
+		HIfMatch:        apiParam("header", HIfMatch, apiString(""), false, "Only write if the value has one of these ETags, or exists for *"),
+		HIfNoneMatch:    apiParam("header", HIfNoneMatch, apiString(""), false, "Only write if the value has none of these ETags, or does not exist for *; for reads, 304 if it has"),
+	}
+}
+
+// raftStatsSchema describes the stats returned by RaftStats, all strings, as reported by raft.
+func raftStatsSchema() apiSchema {
+	props := apiSchema{}
+	for _, name := range []string{
+		"state", "term", "last_log_index", "last_log_term", "commit_index", "applied_index", "fsm_pending",
+		"last_snapshot_index", "last_snapshot_term", "protocol_version", "protocol_version_min",
+		"protocol_version_max", "snapshot_version_min", "snapshot_version_max", "latest_configuration_index",
+		"latest_configuration", "last_contact", "num_peers", "suffrage", "lsm_size", "vlog_size", "replica",
+	} {
+		props[name] = apiString("")
+	}
+	return apiSchema{"type": "object", "properties": props, "additionalProperties": apiString("")}
+}
+
+/*
+	openApiOps describes the methods of every route of WebHandler.Routes. Legacy routes read
+	their parameters from the query string or the form, and answer any method: only the
+	documented ones are listed.
+*/
+func openApiOps() map[string]map[string]apiOp {
+	kvSet := writeOp(apiOp{id: "kvSet", summary: "Set the value of a key", params: []string{PKey, PValue}, status: http.StatusOK, data: ""})
+	kvSetBody := writeOp(apiOp{id: "kvSetBody", summary: "Set the value of a key to the request body", params: []string{PKey},
+		body: map[string]interface{}{VOctetStream: nil, VMultiPartFormData: nil}, status: http.StatusOK, data: ""})
+	bulk := map[string]interface{}{VApplicationJson: []VpKv{}, VNdJson: VpKv{}}
+	v1Cond := map[int]string{http.StatusPreconditionFailed: "The precondition on the current value failed"}
+	raftOp := func(id string, summary string, status int) map[string]apiOp {
+		return map[string]apiOp{Get: {id: id, summary: summary, params: []string{PPeerId}, status: status, data: apiRaftStats}}
+	}
+	healthOp := func(id string, summary string) map[string]apiOp {
+		return map[string]apiOp{Get: {id: id, summary: summary, status: http.StatusOK, data: VpHealth{},
+			more: map[int]string{http.StatusServiceUnavailable: "Not ready, Data holds the failed checks"}}}
+	}
+	return map[string]map[string]apiOp{
+		RKvList: {Get: {id: "kvList", summary: "List keys by prefix, a page at a time",
+			params: []string{PPrefix, POffset, PPageSize}, status: http.StatusOK, data: VpKeyPage{}}},
+		RKvGet: {Get: {id: "kvGet", summary: "Read the value of a key", params: []string{PKey},
+			status: http.StatusOK, content: VOctetStream}},
+		RKvSet: {Get: kvSet, Post: kvSetBody},
+		RKvDel: {Get: writeOp(apiOp{id: "kvDelete", summary: "Delete a key", params: []string{PKey}, status: http.StatusOK, data: ""})},
+		RV1Kv: {
+			Get: {id: "v1KvGet", summary: "Read the value of a key, with its ETag", params: []string{"v1Key", HIfNoneMatch},
+				status: http.StatusOK, content: VOctetStream, more: map[int]string{http.StatusNotModified: "The value matches If-None-Match"}},
+			Head: {id: "v1KvHead", summary: "Read the ETag and length of the value of a key", params: []string{"v1Key", HIfNoneMatch},
+				status: http.StatusOK, content: VOctetStream, more: map[int]string{http.StatusNotModified: "The value matches If-None-Match"}},
+			Put: writeOp(apiOp{id: "v1KvPut", summary: "Set the value of a key to the request body", params: []string{"v1Key", HIfMatch, HIfNoneMatch},
+				body: map[string]interface{}{VOctetStream: nil}, status: http.StatusOK, data: "", more: v1Cond}),
+			Delete: writeOp(apiOp{id: "v1KvDelete", summary: "Delete a key", params: []string{"v1Key", HIfMatch, HIfNoneMatch},
+				status: http.StatusOK, data: "", more: map[int]string{http.StatusPreconditionFailed: v1Cond[http.StatusPreconditionFailed]}}),
+		},
+		RKvBatchGet: {
+			Get: {id: "kvBatchGet", summary: "Read many keys in one consistent view", params: []string{"keys", PFormat},
+				status: http.StatusOK, data: []VpKv{}, stream: VpKv{}},
+			Post: {id: "kvBatchGetBody", summary: "Read many keys in one consistent view, listed in the body", params: []string{PFormat},
+				body: bulk, status: http.StatusOK, data: []VpKv{}, stream: VpKv{}},
+		},
+		RKvBatchSet: {Post: writeOp(apiOp{id: "kvBatchSet", summary: "Set many keys atomically", body: bulk, status: http.StatusOK, data: []string{}})},
+		RKvBatchDel: {Post: writeOp(apiOp{id: "kvBatchDelete", summary: "Delete many keys atomically", body: bulk, status: http.StatusOK, data: []string{}})},
+		RRfJoin: {Get: {id: "raftJoin", summary: "Add a peer to the cluster", params: []string{PPeerId, PNonVoter},
+			status: http.StatusCreated, data: apiRaftStats}},
+		RRfLeave: raftOp("raftLeave", "Remove a peer from the cluster", http.StatusGone),
+		RRfStat:  {Get: {id: "raftStatus", summary: "Raft status of this node", status: http.StatusOK, data: apiRaftStats}},
+		RRfMbrs:  {Get: {id: "raftMembers", summary: "Members of the cluster, with their replication lag", status: http.StatusOK, data: []VpMember{}}},
+		RRfClst:  {Get: {id: "raftCluster", summary: "Status of every node of the cluster", status: http.StatusOK, data: []VpNodeStatus{}}},
+		RRfXfer: {Get: {id: "raftTransferLeadership", summary: "Transfer the leadership to a peer", params: []string{"anyPeerId"},
+			status: http.StatusOK, data: apiRaftStats}},
+		RRfProm: raftOp("raftPromote", "Promote a non-voter to voter", http.StatusOK),
+		RRfDem:  raftOp("raftDemote", "Demote a voter to non-voter", http.StatusOK),
+		RRfAuto: {Get: {id: "raftAutopilot", summary: "Health of the servers as seen by autopilot", status: http.StatusOK,
+			data: []VpServerHealth{}, more: map[int]string{http.StatusNotImplemented: "Autopilot is disabled"}}},
+		RAclPolList: {Get: {id: "aclPolicyList", summary: "List ACL policies", status: http.StatusOK, data: []VpPolicy{}}},
+		RAclPolSet: {Post: {id: "aclPolicySet", summary: "Create or replace an ACL policy",
+			body: map[string]interface{}{VApplicationJson: VpPolicy{}}, status: http.StatusOK, data: ""}},
+		RAclPolDel:  {Get: {id: "aclPolicyDelete", summary: "Delete an ACL policy", params: []string{PName}, status: http.StatusOK, data: ""}},
+		RAclTokList: {Get: {id: "aclTokenList", summary: "List ACL tokens, without their secret", status: http.StatusOK, data: []VpToken{}}},
+		RAclTokNew: {Post: {id: "aclTokenCreate", summary: "Create an ACL token, whose secret is only returned once",
+			body: map[string]interface{}{VApplicationJson: VpToken{}}, status: http.StatusCreated, data: VpTokenSecret{}}},
+		RAclTokDel:  {Get: {id: "aclTokenDelete", summary: "Delete an ACL token", params: []string{PAccessor}, status: http.StatusOK, data: ""}},
+		RAclUsrList: {Get: {id: "aclUserList", summary: "List dashboard users", status: http.StatusOK, data: []VpUser{}}},
+		RAclUsrSet: {Post: {id: "aclUserSet", summary: "Create or replace a dashboard user",
+			body: map[string]interface{}{VApplicationJson: VpUser{}}, status: http.StatusOK, data: ""}},
+		RAclUsrDel: {Get: {id: "aclUserDelete", summary: "Delete a dashboard user", params: []string{PName}, status: http.StatusOK, data: ""}},
+		RAudit: {Get: {id: "audit", summary: "Query the audit log", params: []string{PPrefix, PPrincipal, PFrom, PTo, PLimit, PFormat},
+			status: http.StatusOK, data: []VpAuditEntry{}, stream: VpAuditEntry{}}},
+		RMetrics:      {Get: {id: "metrics", summary: "Metrics, in the Prometheus text format", status: http.StatusOK, content: VTextMetrics}},
+		RHealthLive:   {Get: {id: "healthLive", summary: "Liveness of the node", status: http.StatusOK, data: VpHealth{}}},
+		RHealthReady:  healthOp("healthReady", "Readiness of the node to serve consistent requests"),
+		RHealthLeader: healthOp("healthLeader", "Readiness of the node, which must be the leader"),
+		RAuthWhoami: {Get: {id: "authWhoami", summary: "User of the session", status: http.StatusOK, data: VpWhoami{},
+			more: map[int]string{http.StatusUnauthorized: "The session expired or is invalid"}}},
+		RAuthLogin: {Post: {id: "authLogin", summary: "Log in with a user name and password, setting the session cookie",
+			body: map[string]interface{}{VApplicationJson: VpUser{}}, status: http.StatusOK, data: ""}},
+		RAuthLogout:   {Get: {id: "authLogout", summary: "Clear the session cookie", status: http.StatusOK}},
+		RAuthOidc:     {Get: {id: "authOidcLogin", summary: "Redirect to the OIDC provider to log in", status: http.StatusFound}},
+		RAuthOidcBack: {Get: {id: "authOidcCallback", summary: "Complete an OIDC login and redirect to the dashboard", params: []string{"state", "code"}, status: http.StatusFound}},
+		ROpenApi:      {Get: {id: "openApi", summary: "This OpenAPI document", status: http.StatusOK, content: VApplicationJson}},
+	}
+}
+
+// openApiSpec builds the OpenAPI document of the routes, from openApiOps.
+func openApiSpec() apiSchema {
+	c := apiSchemas{}
+	paths := apiSchema{}
+	for route, methods := range openApiOps() {
+		item := apiSchema{}
+		for method, op := range methods {
+			item[strings.ToLower(method)] = c.operationOf(route, method, &op)
+		}
+		paths[apiPathOf(route)] = item
+	}
+	c["VpRaftStats"] = raftStatsSchema()
+	return apiSchema{
+		"openapi": OpenApiVersion,
+		"info": apiSchema{
+			"title":       "vephar",
+			"version":     version,
+			"description": "Distributed key value store. Writes received by followers are forwarded to the leader.",
+		},
+		"paths": paths,
+		"components": apiSchema{
+			"schemas":    c,
+			"parameters": apiParams(),
+			"responses": apiSchema{
+				"Error": apiSchema{"description": "Error", "content": apiSchema{VApplicationJson: apiSchema{"schema": c.responseOf(nil)}}},
+			},
+			"securitySchemes": apiSchema{
+				"token":   apiSchema{"type": "apiKey", "in": "header", "name": HToken},
+				"bearer":  apiSchema{"type": "http", "scheme": "bearer"},
+				"session": apiSchema{"type": "apiKey", "in": "cookie", "name": CSession},
+			},
+		},
+		// ACLs are optional, and some routes never need a token
+		"security": []apiSchema{{}, {"token": []string{}}, {"bearer": []string{}}, {"session": []string{}}},
+	}
+}
+
+/* ==================================================================================
+                            Request methods
+================================================================================== */
+
+// OpenApiRequest serves the OpenAPI document, built once.
+func (h *WebHandler) OpenApiRequest(w http.ResponseWriter, req *http.Request) {
+	openApiOnce.Do(func() { openApiJson, openApiErr = json.Marshal(openApiSpec()) })
+	if openApiErr != nil {
+		onError(w, openApiErr, http.StatusInternalServerError)
+	} else {
+		writeFile(w, openApiJson, VApplicationJson)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestOpenApiRoutes fails when a route is served without being described, or the other way around.
+func TestOpenApiRoutes(t *testing.T) {
+	h := NewWebHandler(&Server{}, 0, 0)
+	ops := openApiOps()
+	routes := make(map[string]bool)
+	for _, r := range h.Routes() {
+		routes[r.Path] = true
+		if len(ops[r.Path]) == 0 {
+			t.Errorf("route %s is not described in openApiOps", r.Path)
+		}
+	}
+	for route := range ops {
+		if !routes[route] {
+			t.Errorf("openApiOps describes %s, which is not in Routes", route)
+		}
+	}
+	// handlers registered in main rather than in Routes would not be described
+	handlers := 0
+	for i := 0; i < reflect.TypeOf(h).NumMethod(); i++ {
+		if strings.HasSuffix(reflect.TypeOf(h).Method(i).Name, "Request") {
+			handlers++
+		}
+	}
+	if handlers != len(routes) {
+		t.Errorf("%d request handlers for %d routes, every handler must be served by Routes", handlers, len(routes))
+	}
+}
+
+// TestOpenApiDocument checks the served document: its paths, operations and references.
+func TestOpenApiDocument(t *testing.T) {
+	h := NewWebHandler(&Server{}, 0, 0)
+	w := httptest.NewRecorder()
+	h.OpenApiRequest(w, httptest.NewRequest(Get, ROpenApi, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["openapi"] != OpenApiVersion {
+		t.Errorf("openapi: %v", doc["openapi"])
+	}
+	paths := doc["paths"].(map[string]interface{})
+	for _, r := range h.Routes() {
+		if _, ok := paths[apiPathOf(r.Path)]; !ok {
+			t.Errorf("path %s is missing", apiPathOf(r.Path))
+		}
+	}
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	for _, name := range []string{"VpResponse", "VpKeyPage", "VpRaftStats"} {
+		if _, ok := schemas[name]; !ok {
+			t.Errorf("schema %s is missing", name)
+		}
+	}
+	ids := make(map[string]string)
+	for path, item := range paths {
+		for method, op := range item.(map[string]interface{}) {
+			id, _ := op.(map[string]interface{})["operationId"].(string)
+			if len(id) == 0 {
+				t.Errorf("%s %s has no operationId", method, path)
+			} else if other, ok := ids[id]; ok {
+				t.Errorf("%s %s and %s have the same operationId %s", method, path, other, id)
+			}
+			ids[id] = method + " " + path
+		}
+	}
+	checkRefs(t, doc, doc)
+}
+
+// TestOpenApiParams checks the parameters of the operations, as read by their handlers: their location and
+// whether they are required.
+func TestOpenApiParams(t *testing.T) {
+	h := NewWebHandler(&Server{}, 0, 0)
+	w := httptest.NewRecorder()
+	h.OpenApiRequest(w, httptest.NewRequest(Get, ROpenApi, nil))
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	components := doc["components"].(map[string]interface{})["parameters"].(map[string]interface{})
+	// "query name" or "header name", then a * when required
+	params := make(map[string][]string)
+	for _, item := range doc["paths"].(map[string]interface{}) {
+		for _, op := range item.(map[string]interface{}) {
+			op := op.(map[string]interface{})
+			id := op["operationId"].(string)
+			for _, ref := range op["parameters"].([]interface{}) {
+				name := strings.TrimPrefix(ref.(map[string]interface{})["$ref"].(string), ApiRefPrefix+"parameters/")
+				p, ok := components[name].(map[string]interface{})
+				if !ok {
+					t.Errorf("%s: parameter %s is not a component", id, name)
+					continue
+				}
+				param := p["in"].(string) + " " + p["name"].(string)
+				if required, _ := p["required"].(bool); required {
+					param += "*"
+				}
+				params[id] = append(params[id], param)
+			}
+		}
+	}
+	write := []string{"header " + HIdempotencyKey, "query " + PTimeout, "query " + PAsync}
+	v1Cond := []string{"path key*", "header If-Match", "header If-None-Match"}
+	for id, want := range map[string][]string{
+		"kvList":                 {"query prefix", "query offset", "query pageSize*"},
+		"kvGet":                  {"query key*"},
+		"kvSet":                  append([]string{"query key*", "query value"}, write...),
+		"kvSetBody":              append([]string{"query key*"}, write...),
+		"kvDelete":               append([]string{"query key*"}, write...),
+		"v1KvGet":                {"path key*", "header If-None-Match"},
+		"v1KvHead":               {"path key*", "header If-None-Match"},
+		"v1KvPut":                append(v1Cond, write...),
+		"v1KvDelete":             append(v1Cond, write...),
+		"kvBatchGet":             {"query key", "query format"},
+		"kvBatchGetBody":         {"query format"},
+		"kvBatchSet":             write,
+		"kvBatchDelete":          write,
+		"raftJoin":               {"query peerId*", "query nonVoter"},
+		"raftLeave":              {"query peerId*"},
+		"raftTransferLeadership": {"query peerId"},
+		"raftPromote":            {"query peerId*"},
+		"raftDemote":             {"query peerId*"},
+		"aclPolicyDelete":        {"query name*"},
+		"aclTokenDelete":         {"query accessor*"},
+		"aclUserDelete":          {"query name*"},
+		"audit":                  {"query prefix", "query principal", "query from", "query to", "query limit", "query format"},
+		"authOidcCallback":       {"query state*", "query code*"},
+	} {
+		if !reflect.DeepEqual(params[id], want) {
+			t.Errorf("%s: parameters %v, want %v", id, params[id], want)
+		}
+		delete(params, id)
+	}
+	for id, got := range params {
+		if len(got) > 0 {
+			t.Errorf("%s: parameters %v, want none", id, got)
+		}
+	}
+}
+
+// checkRefs fails for each $ref of v which does not resolve in doc.
+func checkRefs(t *testing.T, doc map[string]interface{}, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok {
+			var node interface{} = doc
+			for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+				m, _ := node.(map[string]interface{})
+				node = m[name]
+			}
+			if node == nil {
+				t.Errorf("unresolved reference %s", ref)
+			}
+		}
+		for _, e := range v {
+			checkRefs(t, doc, e)
+		}
+	case []interface{}:
+		for _, e := range v {
+			checkRefs(t, doc, e)
+		}
+	}
+}
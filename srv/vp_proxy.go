@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	HLeader           = "X-Vephar-Leader"
+	HLocation         = "Location"
+	HRetryAfter       = "Retry-After"
+	ForwardRetries    = 5
+	ForwardRetryDelay = 100 * time.Millisecond
+)
+
+var (
+	ErrNotLeader = errors.New("not the leader")
+
+	// hop-by-hop headers, which only apply to a single connection
+	hopHeaders = []string{
+		"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+		"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	}
+)
+
+// VpLeader tells clients redirected by a follower where to send their requests.
+type VpLeader struct {
+	ID       string
+	Http     string
+	Location string
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+// copyHeaders copies end-to-end headers, replacing those already set and skipping hop-by-hop
+// ones, including those named in Connection.
+func copyHeaders(dst, src http.Header) {
+	skip := make(map[string]bool)
+	for _, h := range hopHeaders {
+		skip[h] = true
+	}
+	for _, v := range src["Connection"] {
+		for _, h := range strings.Split(v, ",") {
+			skip[http.CanonicalHeaderKey(strings.TrimSpace(h))] = true
+		}
+	}
+	for k, vs := range src {
+		if skip[k] {
+			continue
+		}
+		dst[k] = append([]string(nil), vs...)
+	}
+}
+
+// isDialError tells whether a request failed before reaching the server, so it can be retried safely.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// forwardBody buffers the request body so it can be sent again on retries.
+func forwardBody(w http.ResponseWriter, req *http.Request) ([]byte, error) {
+	if len(req.PostForm) > 0 { // url-encoded body already consumed by ParseForm
+		return []byte(req.PostForm.Encode()), nil
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	return readTo(http.MaxBytesReader(w, req.Body, MaxUploadSizeMb))
+}
+
+func (h *WebHandler) forwardRequest(req *http.Request, leader string, body []byte) (*http.Request, error) {
+	url := h.s.peerHttp(leader) + req.RequestURI
+	fwd, err := http.NewRequestWithContext(req.Context(), req.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	copyHeaders(fwd.Header, req.Header)
+	fwd.Header.Del("Content-Length")
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := fwd.Header.Get(HForwardedFor); len(prior) > 0 {
+			host = prior + ", " + host
+		}
+		fwd.Header.Set(HForwardedFor, host)
+	}
+	fwd.Header.Set(HOriginNode, h.s.peerId)
+	fwd.Header.Set(HRequestId, requestIdOf(req))
+	h.s.signHop(fwd)
+	return fwd, nil
+}
+
+/* ==================================================================================
+                            Leader forwarding
+================================================================================== */
+
+/*
+	forwardToLeader proxies a request to the leader and relays its response, headers included,
+	with the answering leader in X-Vephar-Leader. Requests which already went through another
+	node, i.e. with X-Vephar-Node authenticated by forwardedBy, are refused with 421 instead
+	of being forwarded again, so that a node which lost its leadership meanwhile sends them back;
+	the forwarding node then resolves the leader again and retries, as it does while no leader
+	is known or can't be dialed. Clients setting X-Vephar-Node themselves are still forwarded.
+*/
+func (h *WebHandler) forwardToLeader(w http.ResponseWriter, req *http.Request) {
+	if h.redirectWrites {
+		h.redirectToLeader(w, req)
+		return
+	}
+	if from := h.forwardedBy(req); len(from) > 0 {
+		log.Warn("refusing to forward a forwarded request", "from", from, "uri", req.RequestURI)
+		onError(w, ErrNotLeader, http.StatusMisdirectedRequest)
+		return
+	}
+	body, err := forwardBody(w, req)
+	if err != nil {
+		onError(w, err, http.StatusBadRequest)
+		return
+	}
+	metrics.IncrCounterWithLabels([]string{"http", "forwarded"}, 1, []metrics.Label{{Name: "route", Value: routeOf(req)}})
+	_, span := StartSpan(req.Context(), "forward "+routeOf(req), SpanClient)
+	defer span.End()
+	span.SetAttr("http.method", req.Method)
+	client := &http.Client{Transport: h.s.client.Transport, Timeout: h.forwardTimeout}
+	deadline := time.Now().Add(h.forwardTimeout)
+	delay := ForwardRetryDelay
+	for attempt := 0; ; attempt++ {
+		leader, err := h.s.leaderId()
+		if err == nil {
+			var fwd *http.Request
+			if fwd, err = h.forwardRequest(req, leader, body); err != nil {
+				onError(w, err, http.StatusInternalServerError)
+				return
+			}
+			accessOf(req).ForwardedTo = leader
+			log.Info("forwarding request", "from", h.s.peerId, "to", leader, "uri", req.RequestURI,
+				"attempt", attempt, "request_id", requestIdOf(req))
+			span.SetAttr("http.url", fwd.URL.String())
+			span.Inject(fwd.Header)
+			var res *http.Response
+			if res, err = client.Do(fwd); err == nil && res.StatusCode != http.StatusMisdirectedRequest {
+				defer res.Body.Close()
+				span.SetAttr("http.status_code", res.StatusCode)
+				copyHeaders(w.Header(), res.Header)
+				w.Header().Set(HLeader, leader)
+				w.WriteHeader(res.StatusCode)
+				io.Copy(w, res.Body)
+				return
+			} else if err == nil {
+				res.Body.Close()
+				err = fmt.Errorf("%s: [%s]", ErrNotLeader, leader)
+			} else if !isDialError(err) && len(req.Header.Get(HIdempotencyKey)) == 0 {
+				// the leader may have received the request, only send it twice if idempotent
+				span.SetError(err)
+				onError(w, err, http.StatusBadGateway)
+				return
+			}
+		}
+		if attempt >= ForwardRetries || time.Now().Add(delay).After(deadline) {
+			span.SetError(err)
+			onError(w, err, http.StatusServiceUnavailable)
+			return
+		}
+		log.Warn("retrying forward to leader", "attempt", attempt, "error", err)
+		metrics.IncrCounter([]string{"http", "forward", "retries"}, 1)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			onError(w, req.Context().Err(), http.StatusServiceUnavailable)
+			return
+		}
+		delay *= 2
+	}
+}
+
+/*
+	redirectToLeader answers with a 307 redirect to the same request on the leader, instead of
+	proxying it, so that clients can send their next requests to the leader directly. The body
+	names the leader too, for clients which don't follow redirects.
+*/
+func (h *WebHandler) redirectToLeader(w http.ResponseWriter, req *http.Request) {
+	leader, err := h.s.leaderId()
+	if err != nil {
+		w.Header().Set(HRetryAfter, "1")
+		onError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	l := VpLeader{ID: leader, Http: h.s.peerHttp(leader)}
+	l.Location = l.Http + req.RequestURI
+	metrics.IncrCounterWithLabels([]string{"http", "redirected"}, 1, []metrics.Label{{Name: "route", Value: routeOf(req)}})
+	w.Header().Set(HLocation, l.Location)
+	w.Header().Set(HLeader, leader)
+	onSuccess(w, &VpResponse{Data: &l}, http.StatusTemporaryRedirect)
+}
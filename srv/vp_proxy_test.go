@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// forwardedReq is a request forwarded by node, as forwardRequest sends it.
+func forwardedReq(t *testing.T, from *Server, node string) *http.Request {
+	req := httptest.NewRequest(Post, RKvSet+"?key=a", nil)
+	req.Header.Set(HOriginNode, node)
+	req.Header.Set(HForwardedFor, "192.0.2.1")
+	req.Header.Set(HRequestId, "request")
+	from.signHop(req)
+	return req
+}
+
+func TestForwardedBy(t *testing.T) {
+	store := newTestStore(t)
+	s := &Server{peerId: testPeerId, store: store, raft: newTestLeader(t, store), aclMaster: testMaster}
+	h := NewWebHandler(s, 0, time.Second)
+	other := &Server{peerId: "other:9090:8080", aclMaster: "other-secret"}
+	stale := forwardedReq(t, s, testPeerId)
+	at := time.Now().Add(-2 * HopMaxSkew).Unix()
+	stale.Header.Set(HHopSignature, fmt.Sprintf("%d:%s", at, s.hopMacOf(testPeerId, "192.0.2.1", "request", at)))
+	tampered := forwardedReq(t, s, testPeerId)
+	tampered.Header.Set(HForwardedFor, "192.0.2.2")
+	unsigned := forwardedReq(t, s, testPeerId)
+	unsigned.Header.Del(HHopSignature)
+	for _, c := range []struct {
+		name string
+		req  *http.Request
+		want string
+	}{
+		{"signed", forwardedReq(t, s, testPeerId), testPeerId},
+		{"unsigned", unsigned, ""},
+		{"tampered", tampered, ""},
+		{"stale", stale, ""},
+		{"other key", forwardedReq(t, other, testPeerId), ""},
+		{"not a server", forwardedReq(t, s, other.peerId), ""},
+	} {
+		if node := h.forwardedBy(c.req); node != c.want {
+			t.Errorf("%s: forwarded by %q, want %q", c.name, node, c.want)
+		}
+	}
+	if o := h.originOf(forwardedReq(t, s, testPeerId)); o.Node != testPeerId || o.Client != "192.0.2.1" {
+		t.Errorf("origin of a signed request: %+v", o)
+	}
+	if o := h.originOf(unsigned); o.Node != testPeerId || o.Client != unsigned.RemoteAddr {
+		t.Errorf("origin of an unsigned request: %+v", o)
+	}
+
+	// over HTTPS, nodes are authenticated by their client certificate without a shared key
+	s.aclMaster = ""
+	pki := newTestPki(t)
+	s.https = pki.issue(t, "node", pki, "localhost")
+	certOf := func(store *TlsStore) *x509.Certificate {
+		cert, _ := store.current()
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf
+	}
+	for _, c := range []struct {
+		name string
+		cert *x509.Certificate
+		want string
+	}{
+		{"certificate of the node", certOf(pki.issue(t, "peer", pki, "localhost")), testPeerId},
+		{"certificate of another host", certOf(pki.issue(t, "peer", pki, "other")), ""},
+		{"certificate of another CA", certOf(newTestPki(t).issue(t, "peer", pki, "localhost")), ""},
+	} {
+		req := forwardedReq(t, s, testPeerId)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.cert}}
+		if node := h.forwardedBy(req); node != c.want {
+			t.Errorf("%s: forwarded by %q, want %q", c.name, node, c.want)
+		}
+	}
+}
+
+// TestForwardLoop checks that a node refuses to forward a request another node forwarded to it.
+func TestForwardLoop(t *testing.T) {
+	store := newTestStore(t)
+	s := &Server{peerId: testPeerId, store: store, raft: newTestLeader(t, store), aclMaster: testMaster, client: &http.Client{}}
+	h := NewWebHandler(s, 0, 200*time.Millisecond)
+	w := httptest.NewRecorder()
+	h.forwardToLeader(w, forwardedReq(t, s, testPeerId))
+	if w.Code != http.StatusMisdirectedRequest {
+		t.Errorf("forwarded request: %d, want 421", w.Code)
+	}
+	// a client setting the header itself is forwarded, here to a leader which can't be reached
+	req := forwardedReq(t, s, testPeerId)
+	req.Header.Del(HHopSignature)
+	w = httptest.NewRecorder()
+	h.forwardToLeader(w, req)
+	if w.Code == http.StatusMisdirectedRequest {
+		t.Error("request with an unsigned X-Vephar-Node refused as forwarded")
+	}
+}
+
+// TestRedirectRoute checks that redirects are counted by route, rather than by path, which holds the key.
+func TestRedirectRoute(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	conf := metrics.DefaultConfig("test")
+	conf.EnableHostname, conf.EnableRuntimeMetrics = false, false
+	if _, err := metrics.NewGlobal(conf, sink); err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.NewGlobal(conf, &metrics.BlackholeSink{})
+	store := newTestStore(t)
+	s := &Server{peerId: testPeerId, store: store, raft: newTestLeader(t, store)}
+	h := NewWebHandler(s, 0, time.Second)
+	h.redirectWrites = true
+	w := httptest.NewRecorder()
+	Access(RV1Kv, nil, h.forwardToLeader)(w, httptest.NewRequest(Put, RV1Kv+"secret/key", nil))
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get(HLocation) != "http://localhost:8080"+RV1Kv+"secret/key" {
+		t.Fatalf("%d to %s", w.Code, w.Header().Get(HLocation))
+	}
+	counted := false
+	for name := range sink.Data()[0].Counters {
+		if strings.Contains(name, "secret") {
+			t.Errorf("key in the metric %s", name)
+		}
+		counted = counted || (strings.Contains(name, "redirected") && strings.Contains(name, "route="+RV1Kv))
+	}
+	if !counted {
+		t.Errorf("redirect not counted by route: %v", sink.Data()[0].Counters)
+	}
+}
+
+// TestForwardToLeader checks that a write sent to a follower is applied by the leader, which answers it.
+func TestForwardToLeader(t *testing.T) {
+	nodes, _ := newTestHttpCluster(t, 2)
+	leader, follower := nodes[0], nodes[1]
+	req, err := http.NewRequest(Put, follower.peerHttp(follower.peerId)+RV1Kv+"a", strings.NewReader("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get(HLeader) != leader.peerId || res.Header.Get(HIndex) == "" {
+		t.Errorf("%d from %s, index %s", res.StatusCode, res.Header.Get(HLeader), res.Header.Get(HIndex))
+	}
+	if v := valueOf(t, leader.store, "a"); v != "b" {
+		t.Errorf("value %q on the leader", v)
+	}
+}
+
+// TestForwardRetries checks that a forwarded request is sent again when the leader refuses it, or
+// when its connection drops, only if it is idempotent.
+func TestForwardRetries(t *testing.T) {
+	var calls int
+	var answer func(w http.ResponseWriter)
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		answer(w)
+	}))
+	defer leader.Close()
+	nodes := newTestClusterOf(t, "127.0.0.1:9090:"+leader.URL[strings.LastIndex(leader.URL, ":")+1:], "127.0.0.1:9091:8080")
+	follower := nodes[1]
+	waitFor(t, "a known leader", func() bool { _, err := follower.leaderId(); return err == nil })
+	h := NewWebHandler(follower, 0, 2*time.Second)
+
+	misdirected := func(w http.ResponseWriter) {
+		if calls == 1 {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+		}
+	}
+	dropped := func(w http.ResponseWriter) {
+		if calls == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}
+	for _, c := range []struct {
+		name       string
+		answer     func(w http.ResponseWriter)
+		idempotent bool
+		want       int
+		wantCalls  int
+	}{
+		{"misdirected", misdirected, false, http.StatusOK, 2},
+		{"dropped", dropped, false, http.StatusBadGateway, 1},
+		{"dropped idempotent", dropped, true, http.StatusOK, 2},
+	} {
+		calls, answer = 0, c.answer
+		req := httptest.NewRequest(Put, RV1Kv+"a", strings.NewReader("b"))
+		if c.idempotent {
+			req.Header.Set(HIdempotencyKey, "k")
+		}
+		w := httptest.NewRecorder()
+		h.forwardToLeader(w, req)
+		if w.Code != c.want || calls != c.wantCalls {
+			t.Errorf("%s: %d after %d calls, want %d after %d", c.name, w.Code, calls, c.want, c.wantCalls)
+		}
+	}
+}
+
+// TestRedirectToLeader checks that in redirect mode a follower names the leader, and that clients
+// following the redirect get their write applied.
+func TestRedirectToLeader(t *testing.T) {
+	nodes, handlers := newTestHttpCluster(t, 2)
+	leader, follower := nodes[0], nodes[1]
+	handlers[1].redirectWrites = true
+	put := func(client *http.Client) *http.Response {
+		req, err := http.NewRequest(Put, follower.peerHttp(follower.peerId)+RV1Kv+"a", strings.NewReader("b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	res := put(&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }})
+	var l VpLeader
+	if err := json.NewDecoder(res.Body).Decode(&VpResponse{Data: &l}); err != nil {
+		t.Fatal(err)
+	}
+	location := leader.peerHttp(leader.peerId) + RV1Kv + "a"
+	if res.StatusCode != http.StatusTemporaryRedirect || res.Header.Get(HLocation) != location ||
+		l.ID != leader.peerId || l.Location != location {
+		t.Errorf("%d to %s, %+v", res.StatusCode, res.Header.Get(HLocation), l)
+	}
+	if v := valueOf(t, leader.store, "a"); v != "" {
+		t.Errorf("value %q written by the redirect", v)
+	}
+
+	if res := put(http.DefaultClient); res.StatusCode != http.StatusOK || res.Request.URL.String() != location {
+		t.Errorf("%d from %s", res.StatusCode, res.Request.URL)
+	}
+	if v := valueOf(t, leader.store, "a"); v != "b" {
+		t.Errorf("value %q on the leader", v)
+	}
+}
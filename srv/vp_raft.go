@@ -1,23 +1,96 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
 )
 
+const (
+	PeerStatsTimeout   = 2 * time.Second
+	MemberStatsTimeout = 500 * time.Millisecond // members answer with what they have by then
+	MemberStatsTtl     = 2 * time.Second
+	LeaveTimeout       = 10 * time.Second // bounds the shutdown of a node leaving through an unresponsive leader
+)
+
+var (
+	ErrNoLeader = errors.New("leader not found")
+)
+
+/*
+	VpMember is a server of the configuration. When queried on the leader, LastLogIndex and Lag
+	tell how far each follower's log goes, as reported by its own /raft/status: that is the last
+	entry it stored, which may not be committed yet, not the leader's match index.
+*/
+type VpMember struct {
+	ID           string
+	Raft         string
+	Http         string
+	Suffrage     string
+	Leader       bool
+	LastLogIndex uint64
+	Lag          uint64
+	Error        string // set when the leader could not query the follower
+}
+
+// peerStatsCache keeps the stats of other nodes for MemberStatsTtl, for /raft/members.
+type peerStatsCache struct {
+	mu      sync.Mutex
+	entries map[string]*peerStatsEntry
+}
+
+type peerStatsEntry struct {
+	stats map[string]string
+	err   error
+	at    time.Time
+}
+
+type VpNodeStatus struct {
+	ID           string
+	Reachable    bool
+	State        string
+	Term         uint64
+	AppliedIndex uint64
+	CommitIndex  uint64
+	LastContact  string
+	LsmSize      int64
+	VlogSize     int64
+	Error        string
+}
+
 type Server struct {
 	peerId    string // host:raftPort:httpPort TODO this may be an issue for IPV6 addresses
 	bootPeers map[string]bool
 	dataDir   string
+	nonVoter  bool // replicas wait to be added by the leader instead of bootstrapping
 	raft      *raft.Raft
 	store     *BadgerStore
+	autopilot *Autopilot
+	admission *Admission
+	tls       *TlsStore // mutual TLS for the raft transport when set
+	https     *TlsStore // HTTPS for the API, UI and node to node requests when set
+	client    *http.Client
+	aclMaster string // token with every right, also used for node to node requests. Enables ACLs when set
+	sessions  *Sessions
+	metrics   *PromSink
+	rpc       *Rpc // set when followers submit commands to the leader over the raft port
+	useRpc    bool
+	batcher   *Batcher // coalesces concurrent writes on the leader when set
+	writeWait time.Duration
+	writeMax  time.Duration // upper bound of the write timeouts requested by clients
+	stopping  int32
+	peers     peerStatsCache
 }
 
 func parsePeer(peer string) (string, string) {
@@ -25,30 +98,166 @@ func parsePeer(peer string) (string, string) {
 	return fmt.Sprintf("%s:%s", peerCfg[0], peerCfg[1]), peerCfg[2]
 }
 
-func NewServer(dataDir string, peerId string, bootPeers []string) *Server {
+// peerHttp derives the HTTP base URL of a node from its peer ID.
+func (s *Server) peerHttp(peerId string) string {
+	scheme := "http"
+	if s.https != nil {
+		scheme = "https"
+	}
+	peerRaft, httpPort := parsePeer(peerId)
+	return fmt.Sprintf("%s://%s:%s", scheme, strings.Split(peerRaft, ":")[0], httpPort) // TODO this may need to be customized
+}
+
+// leaderId resolves the peer ID of the current cluster leader.
+func (s *Server) leaderId() (string, error) {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return "", err
+	}
+	leader := s.raft.Leader()
+	for _, peer := range configFuture.Configuration().Servers {
+		if len(leader) > 0 && peer.Address == leader {
+			return string(peer.ID), nil
+		}
+	}
+	return "", ErrNoLeader
+}
+
+/*
+	peerHosts lists the hosts of the servers of the configuration and of the boot peers, which
+	raft peers must present a certificate for. Until the node is part of a configuration, only the
+	boot peers are listed, and none when there are no other boot peers, e.g. a replica started
+	without -join: any peer signed by the CA is accepted then.
+*/
+func (s *Server) peerHosts() []string {
+	hosts := make([]string, 0)
+	if s.raft != nil {
+		if configFuture := s.raft.GetConfiguration(); configFuture.Error() == nil {
+			for _, srv := range configFuture.Configuration().Servers {
+				hosts = append(hosts, strings.Split(string(srv.ID), ":")[0])
+			}
+		}
+	}
+	others := false
+	for peerId := range s.bootPeers {
+		others = others || (len(peerId) > 0 && peerId != s.peerId)
+	}
+	if len(hosts) == 0 && !others {
+		return nil
+	}
+	for peerId := range s.bootPeers {
+		if len(peerId) > 0 {
+			hosts = append(hosts, strings.Split(peerId, ":")[0])
+		}
+	}
+	return hosts
+}
+
+// leaderHttp resolves the HTTP base URL of the current cluster leader.
+func (s *Server) leaderHttp() (string, error) {
+	leader, err := s.leaderId()
+	if err != nil {
+		return "", err
+	}
+	return s.peerHttp(leader), nil
+}
+
+// peerGet issues a node to node request, authorized with the master token.
+func (s *Server) peerGet(client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.AclEnabled() {
+		req.Header.Set(HToken, s.aclMaster)
+	}
+	req.Header.Set(HOriginNode, s.peerId)
+	return client.Do(req)
+}
+
+// peerStats queries the raft status endpoint of another cluster node.
+func (s *Server) peerStats(peerId string, timeout time.Duration) (map[string]string, error) {
+	client := http.Client{Transport: s.client.Transport, Timeout: timeout}
+	res, err := s.peerGet(&client, s.peerHttp(peerId)+RRfStat)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	stats := make(map[string]string)
+	vpRes := VpResponse{Data: &stats}
+	if err := json.NewDecoder(res.Body).Decode(&vpRes); err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer status failed: %s %s", res.Status, vpRes.Error)
+	}
+	return stats, nil
+}
+
+// cachedPeerStats is peerStats with a short timeout, cached for MemberStatsTtl.
+func (s *Server) cachedPeerStats(peerId string) (map[string]string, error) {
+	s.peers.mu.Lock()
+	e, ok := s.peers.entries[peerId]
+	s.peers.mu.Unlock()
+	if ok && time.Since(e.at) < MemberStatsTtl {
+		return e.stats, e.err
+	}
+	stats, err := s.peerStats(peerId, MemberStatsTimeout)
+	s.peers.mu.Lock()
+	defer s.peers.mu.Unlock()
+	if s.peers.entries == nil {
+		s.peers.entries = make(map[string]*peerStatsEntry)
+	}
+	s.peers.entries[peerId] = &peerStatsEntry{stats: stats, err: err, at: time.Now()}
+	return stats, err
+}
+
+func NewServer(dataDir string, peerId string, bootPeers []string, nonVoter bool) *Server {
 	bootSet := make(map[string]bool)
 	bootSet[peerId] = true
 	for _, peer := range bootPeers {
 		bootSet[peer] = true
 	}
-	return &Server{peerId: peerId, dataDir: dataDir, bootPeers: bootSet}
+	return &Server{
+		peerId: peerId, dataDir: dataDir, bootPeers: bootSet, nonVoter: nonVoter, client: &http.Client{},
+		writeWait: DefaultWriteTimeout, writeMax: DefaultWriteTimeout,
+	}
 }
 
 // This will start the Raft node and will join the cluster after the end.
 func (s *Server) Start() error {
+	if s.https != nil {
+		s.client.Transport = s.https.HttpTransport()
+	}
+
 	raftConfig := raft.DefaultConfig()
 	raftConfig.LocalID = raft.ServerID(s.peerId)
+	raftConfig.NoSnapshotRestoreOnStart = true // badger already holds the state machine
 	raftAddr, _ := parsePeer(s.peerId)
 
-	addr, err := net.ResolveTCPAddr("tcp", raftAddr)
+	_, err := net.ResolveTCPAddr("tcp", raftAddr)
 	if err != nil {
 		return err
 	}
+	addr := peerAddr(raftAddr) // not resolved, see peerAddr
 
-	trans, err := raft.NewTCPTransport(raftAddr, addr, 3, 10*time.Second, os.Stderr)
-	if err != nil {
+	var stream raft.StreamLayer
+	if s.tls != nil {
+		s.tls.peerHosts = s.peerHosts
+		if stream, err = NewTlsStreamLayer(raftAddr, addr, s.tls); err != nil {
+			return err
+		}
+	} else if stream, err = NewTcpStreamLayer(raftAddr, addr); err != nil {
 		return err
 	}
+	if s.useRpc && s.tls == nil {
+		log.Warn("rpc forwarding requires mutual TLS (-tlsCa), proxying writes over HTTP instead")
+	} else if s.useRpc {
+		mux := NewMuxStreamLayer(stream)
+		s.rpc = NewRpc(s, mux)
+		stream = mux
+	}
+	trans := raft.NewNetworkTransport(stream, 3, 10*time.Second, os.Stderr)
 
 	if _, err := os.Stat(s.dataDir); os.IsNotExist(err) {
 		if err = os.Mkdir(s.dataDir, 0755); err != nil {
@@ -79,6 +288,18 @@ func (s *Server) Start() error {
 	s.raft = ra
 	s.store = bst
 
+	if s.autopilot != nil {
+		s.autopilot.Start()
+	}
+	if s.batcher != nil {
+		s.batcher.Start()
+	}
+
+	if s.nonVoter {
+		log.Info("Waiting to be added as a non-voter", "peerId", s.peerId)
+		return nil
+	}
+
 	var servers []raft.Server
 	for peerId := range s.bootPeers {
 		log.Info("Registering", "peerId", peerId)
@@ -96,55 +317,299 @@ func (s *Server) Start() error {
 	return nil
 }
 
-func (s *Server) RaftSet(key string, value []byte) error {
-	if log.IsDebug() {
-		log.Debug("Log Set", "k", key, "v", value)
+func (s *Server) raftApply(command *VpLogCmd) error {
+	return s.raftSubmit(context.Background(), command, nil)
+}
+
+/*
+	raftSubmit applies a command, through the leader over RPC when this node is a follower. It waits
+	until the command is applied, or only appended to the leader's log with wr.Async, for at most
+	writeWait or until ctx is done, and sets wr.Index to the index of its log entry.
+*/
+func (s *Server) raftSubmit(ctx context.Context, command *VpLogCmd, wr *VpWrite) error {
+	if wr == nil {
+		wr = &VpWrite{}
+	}
+	if err := s.store.CheckTxn(command); err != nil {
+		return err
 	}
-	command := &VpLogCmd{Op: CMDSET, Key: key, Value: value}
 	buff, err := json.Marshal(command)
 	if err != nil {
 		return err
 	}
-	future := s.raft.Apply(buff, 10*time.Second)
-	if err := future.Error(); err != nil {
+	timeout := s.writeWait
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return ErrWriteTimeout
+		}
+	}
+	if s.rpc != nil && s.raft.State() != raft.Leader {
+		req := VpRpcRequest{
+			Command: buff, Trace: command.Trace, TimeoutMs: timeout.Milliseconds(), Async: wr.Async,
+			Token: wr.Token, Session: wr.Session,
+		}
+		reply, err := s.rpc.Apply(ctx, &req, len(command.Id) > 0)
+		if reply != nil {
+			accessOfContext(ctx).ForwardedTo = reply.Leader
+		}
+		if err != nil {
+			return err
+		}
+		wr.Index = reply.Index
+		accessOfContext(ctx).Replayed = reply.Replayed
+		if len(reply.Error) > 0 {
+			return errors.New(reply.Error)
+		}
+		return nil
+	}
+	index, res, err := s.leaderApply(ctx, command, buff, wr.Async, timeout)
+	if err != nil {
 		return err
 	}
+	wr.Index = index
+	if res != nil {
+		accessOfContext(ctx).Replayed = res.Replayed
+		return res.Error
+	}
 	return nil
 }
 
-func (s *Server) RaftDelete(key string) error {
+/*
+	leaderApply appends an encoded command to the log, batched with concurrent writes if enabled,
+	and waits for it to be applied, or only appended when async. Async writes aren't batched.
+*/
+func (s *Server) leaderApply(ctx context.Context, command *VpLogCmd, buff []byte, async bool, timeout time.Duration) (uint64, *VpRpcResponse, error) {
+	if s.admission != nil && (command.Op == CMDSET || command.Op == CMDDEL || command.Op == CMDBATCH) {
+		release, err := s.admission.Acquire()
+		if err != nil {
+			return 0, nil, err
+		}
+		defer release()
+	}
+	if async {
+		return s.leaderAppend(ctx, buff, timeout)
+	}
+	if s.batcher != nil && (command.Op == CMDSET || command.Op == CMDDEL) {
+		return s.batcher.Submit(ctx, command, timeout)
+	}
+	return waitApplied(ctx, s.raft.Apply(buff, timeout), timeout)
+}
+
+// RaftSet sets a key. Writes with the idempotency key of a write applied recently are not applied again.
+func (s *Server) RaftSet(ctx context.Context, key string, value []byte, wr *VpWrite, o *VpOrigin) error {
+	if log.IsDebug() {
+		log.Debug("Log Set", "k", key, "v", value)
+	}
+	_, span := StartSpan(ctx, "raft.set", SpanInternal)
+	defer span.End()
+	span.SetAttr("vephar.key", key)
+	span.SetAttr("vephar.value_size", len(value))
+	err := s.raftSubmit(ctx, &VpLogCmd{Op: CMDSET, Key: key, Value: value, Origin: o, Trace: span.TraceParent(), Id: wr.Id, Cond: wr.Cond}, wr)
+	span.SetError(err)
+	return err
+}
+
+func (s *Server) RaftDelete(ctx context.Context, key string, wr *VpWrite, o *VpOrigin) error {
 	if log.IsDebug() {
 		log.Debug("Log del", "k", key)
 	}
-	command := &VpLogCmd{Op: CMDDEL, Key: key}
-	buff, err := json.Marshal(command)
-	if err != nil {
-		return err
+	_, span := StartSpan(ctx, "raft.delete", SpanInternal)
+	defer span.End()
+	span.SetAttr("vephar.key", key)
+	err := s.raftSubmit(ctx, &VpLogCmd{Op: CMDDEL, Key: key, Origin: o, Trace: span.TraceParent(), Id: wr.Id, Cond: wr.Cond}, wr)
+	span.SetError(err)
+	return err
+}
+
+// RaftJoin adds peerId to the cluster, either as a voter or as a non-voting replica
+// which receives the log without taking part in elections or commit quorums. With autopilot,
+// voters join as non-voters staged for promotion, in the replicated state.
+func (s *Server) RaftJoin(peerId string, nonVoter bool, o *VpOrigin) error {
+	if s.raft.State() != raft.Leader {
+		return errors.New("not the leader")
 	}
-	future := s.raft.Apply(buff, 10*time.Second)
-	if err := future.Error(); err != nil {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
 		return err
 	}
+	peerRaft, _ := parsePeer(peerId)
+	staged := false
+	if !nonVoter && s.autopilot != nil {
+		if suffrage, err := s.suffrageOf(peerId); err != nil || suffrage != raft.Voter {
+			nonVoter, staged = true, true // promoted by autopilot once stable
+		}
+	}
+	var f raft.IndexFuture
+	action := "join voter"
+	if nonVoter {
+		action = "join non-voter"
+		f = s.raft.AddNonvoter(raft.ServerID(peerId), raft.ServerAddress(peerRaft), 0, 0)
+	} else {
+		f = s.raft.AddVoter(raft.ServerID(peerId), raft.ServerAddress(peerRaft), 0, 0)
+	}
+	if f.Error() != nil {
+		return f.Error()
+	}
+	if staged {
+		s.auditMemberAs(CMDSTAGE, peerId, "join non-voter staged for promotion", f.Index(), o)
+	} else {
+		s.auditMember(peerId, action, f.Index(), o)
+	}
 	return nil
 }
 
-func (s *Server) RaftJoin(peerId string) error {
+// RaftPromote turns an existing non-voter into a voter.
+func (s *Server) RaftPromote(peerId string, o *VpOrigin) error {
 	if s.raft.State() != raft.Leader {
 		return errors.New("not the leader")
 	}
-	configFuture := s.raft.GetConfiguration()
-	if err := configFuture.Error(); err != nil {
+	suffrage, err := s.suffrageOf(peerId)
+	if err != nil {
 		return err
 	}
+	if suffrage != raft.Nonvoter {
+		return fmt.Errorf("peer is not a non-voter: [%s]", peerId)
+	}
 	peerRaft, _ := parsePeer(peerId)
 	f := s.raft.AddVoter(raft.ServerID(peerId), raft.ServerAddress(peerRaft), 0, 0)
 	if f.Error() != nil {
 		return f.Error()
 	}
+	s.auditMember(peerId, "promote", f.Index(), o)
+	return nil
+}
+
+// RaftDemote turns an existing voter into a non-voter.
+func (s *Server) RaftDemote(peerId string, o *VpOrigin) error {
+	if s.raft.State() != raft.Leader {
+		return errors.New("not the leader")
+	}
+	suffrage, err := s.suffrageOf(peerId)
+	if err != nil {
+		return err
+	}
+	if suffrage != raft.Voter {
+		return fmt.Errorf("peer is not a voter: [%s]", peerId)
+	}
+	f := s.raft.DemoteVoter(raft.ServerID(peerId), 0, 0)
+	if f.Error() != nil {
+		return f.Error()
+	}
+	s.auditMember(peerId, "demote", f.Index(), o)
 	return nil
 }
 
-func (s *Server) RaftLeave(peerId string) error {
+func (s *Server) suffrageOf(peerId string) (raft.ServerSuffrage, error) {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return 0, err
+	}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(peerId) {
+			return srv.Suffrage, nil
+		}
+	}
+	return 0, fmt.Errorf("peer not found: [%s]", peerId)
+}
+
+// RaftMembers lists the servers in the current configuration. On the leader, each
+// follower is queried for the last log index it has stored to derive its replication lag.
+func (s *Server) RaftMembers() ([]VpMember, error) {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, err
+	}
+	isLeader := s.raft.State() == raft.Leader
+	leaderIdx := s.raft.LastIndex()
+	servers := configFuture.Configuration().Servers
+	members := make([]VpMember, len(servers))
+	var wg sync.WaitGroup
+	for i, srv := range servers {
+		members[i] = VpMember{
+			ID: string(srv.ID), Raft: string(srv.Address), Http: s.peerHttp(string(srv.ID)),
+			Suffrage: srv.Suffrage.String(), Leader: srv.Address == s.raft.Leader(),
+		}
+		if !isLeader {
+			continue
+		}
+		if string(srv.ID) == s.peerId {
+			members[i].LastLogIndex = leaderIdx
+			continue
+		}
+		wg.Add(1)
+		go func(m *VpMember) {
+			defer wg.Done()
+			stats, err := s.cachedPeerStats(m.ID)
+			if err != nil {
+				m.Error = err.Error()
+				return
+			}
+			m.LastLogIndex, _ = strconv.ParseUint(stats["last_log_index"], 10, 64)
+			if m.LastLogIndex < leaderIdx {
+				m.Lag = leaderIdx - m.LastLogIndex
+			}
+		}(&members[i])
+	}
+	wg.Wait()
+	return members, nil
+}
+
+// RaftStats extends raft.Stats with this node's suffrage and disk usage.
+func (s *Server) RaftStats() map[string]string {
+	stats := s.raft.Stats()
+	if suffrage, err := s.suffrageOf(s.peerId); err != nil {
+		stats["suffrage"] = "Unknown"
+	} else {
+		stats["suffrage"] = suffrage.String()
+	}
+	lsm, vlog := s.store.Size()
+	stats["lsm_size"] = strconv.FormatInt(lsm, 10)
+	stats["vlog_size"] = strconv.FormatInt(vlog, 10)
+	stats["replica"] = strconv.FormatBool(s.nonVoter)
+	return stats
+}
+
+// ClusterStatus queries the status of every server in the configuration, this node included.
+func (s *Server) ClusterStatus() ([]VpNodeStatus, error) {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, err
+	}
+	servers := configFuture.Configuration().Servers
+	nodes := make([]VpNodeStatus, len(servers))
+	var wg sync.WaitGroup
+	for i, srv := range servers {
+		nodes[i].ID = string(srv.ID)
+		if string(srv.ID) == s.peerId {
+			nodes[i].fill(s.RaftStats())
+			continue
+		}
+		wg.Add(1)
+		go func(n *VpNodeStatus) {
+			defer wg.Done()
+			if stats, err := s.peerStats(n.ID, PeerStatsTimeout); err != nil {
+				n.Error = err.Error()
+			} else {
+				n.fill(stats)
+			}
+		}(&nodes[i])
+	}
+	wg.Wait()
+	return nodes, nil
+}
+
+func (n *VpNodeStatus) fill(stats map[string]string) {
+	n.Reachable = true
+	n.State = stats["state"]
+	n.Term, _ = strconv.ParseUint(stats["term"], 10, 64)
+	n.AppliedIndex, _ = strconv.ParseUint(stats["applied_index"], 10, 64)
+	n.CommitIndex, _ = strconv.ParseUint(stats["commit_index"], 10, 64)
+	n.LastContact = stats["last_contact"]
+	n.LsmSize, _ = strconv.ParseInt(stats["lsm_size"], 10, 64)
+	n.VlogSize, _ = strconv.ParseInt(stats["vlog_size"], 10, 64)
+}
+
+func (s *Server) RaftLeave(peerId string, o *VpOrigin) error {
 	if s.raft.State() != raft.Leader {
 		return errors.New("not the leader")
 	}
@@ -152,9 +617,79 @@ func (s *Server) RaftLeave(peerId string) error {
 	if err := configFuture.Error(); err != nil {
 		return err
 	}
+	if peerId == s.peerId { // a leader removing itself can no longer apply commands afterwards
+		s.auditMember(peerId, "leave requested by the leader", 0, o)
+	}
 	future := s.raft.RemoveServer(raft.ServerID(peerId), 0, 0)
 	if err := future.Error(); err != nil {
 		return err
 	}
+	if peerId != s.peerId {
+		s.auditMember(peerId, "leave", future.Index(), o)
+	}
+	return nil
+}
+
+// RaftTransferLeadership hands leadership over to peerId, or to the most
+// up-to-date follower when peerId is empty.
+func (s *Server) RaftTransferLeadership(peerId string) error {
+	if s.raft.State() != raft.Leader {
+		return errors.New("not the leader")
+	}
+	var future raft.Future
+	if len(peerId) == 0 {
+		future = s.raft.LeadershipTransfer()
+	} else {
+		peerRaft, _ := parsePeer(peerId)
+		future = s.raft.LeadershipTransferToServer(raft.ServerID(peerId), raft.ServerAddress(peerRaft))
+	}
+	return future.Error()
+}
+
+// Stop shuts the node down. When leave is set, the node first removes itself from the
+// cluster configuration (directly if it is the leader, through the leader otherwise).
+// A leader that stays in the configuration hands leadership over before stopping.
+func (s *Server) Stop(leave bool) error {
+	if s.raft == nil {
+		return nil
+	}
+	if s.autopilot != nil {
+		s.autopilot.Stop()
+	}
+	if s.batcher != nil {
+		s.batcher.Stop()
+	}
+	if leave {
+		if err := s.leaveCluster(); err != nil {
+			log.Warn("failed to leave cluster", "peerId", s.peerId, "error", err)
+		}
+	} else if s.raft.State() == raft.Leader {
+		if err := s.RaftTransferLeadership(""); err != nil {
+			log.Warn("failed to transfer leadership", "peerId", s.peerId, "error", err)
+		}
+	}
+	if err := s.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	return s.store.Close()
+}
+
+func (s *Server) leaveCluster() error {
+	if s.raft.State() == raft.Leader {
+		return s.RaftLeave(s.peerId, s.systemOrigin("shutdown"))
+	}
+	leader, err := s.leaderHttp()
+	if err != nil {
+		return err
+	}
+	client := http.Client{Transport: s.client.Transport, Timeout: LeaveTimeout}
+	res, err := s.peerGet(&client, fmt.Sprintf("%s%s?%s=%s", leader, RRfLeave, PPeerId, url.QueryEscape(s.peerId)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusGone {
+		return fmt.Errorf("leader rejected leave request: %s", res.Status)
+	}
 	return nil
 }
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// newTestCluster runs n voters in memory, connected to each other, with the first one as leader.
+func newTestCluster(t *testing.T, n int) []*Server {
+	peerIds := make([]string, n)
+	for i := range peerIds {
+		peerIds[i] = fmt.Sprintf("node%d:9090:8080", i)
+	}
+	return newTestClusterOf(t, peerIds...)
+}
+
+// newTestClusterOf runs a voter in memory for each peer ID, at its raft address, with the first one as leader.
+func newTestClusterOf(t *testing.T, peerIds ...string) []*Server {
+	nodes := make([]*Server, len(peerIds))
+	inmem := make([]*raft.InmemTransport, len(peerIds))
+	for i := range nodes {
+		nodes[i] = NewServer("", peerIds[i], nil, false)
+		peerRaft, _ := parsePeer(peerIds[i])
+		_, inmem[i] = raft.NewInmemTransport(raft.ServerAddress(peerRaft))
+	}
+	transports := make([]raft.Transport, len(inmem))
+	for i := range inmem {
+		transports[i] = inmem[i]
+		for j := range inmem {
+			if i != j {
+				inmem[i].Connect(inmem[j].LocalAddr(), inmem[j])
+			}
+		}
+	}
+	startTestCluster(t, nodes, transports)
+	return nodes
+}
+
+// startTestCluster runs raft on each node with its transport, bootstraps the first one and adds the others as voters.
+func startTestCluster(t *testing.T, nodes []*Server, transports []raft.Transport) {
+	for i, s := range nodes {
+		conf := raft.DefaultConfig()
+		conf.LocalID = raft.ServerID(s.peerId)
+		conf.HeartbeatTimeout, conf.ElectionTimeout = 50*time.Millisecond, 50*time.Millisecond
+		conf.LeaderLeaseTimeout, conf.CommitTimeout = 50*time.Millisecond, 5*time.Millisecond
+		conf.Logger = hclog.NewNullLogger()
+		s.store = newTestStore(t)
+		logs := raft.NewInmemStore()
+		r, err := raft.NewRaft(conf, s.store, logs, logs, raft.NewInmemSnapshotStore(), transports[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.raft = r
+		t.Cleanup(func() { r.Shutdown().Error() })
+	}
+	leader := nodes[0]
+	if err := leader.raft.BootstrapCluster(raft.Configuration{Servers: []raft.Server{
+		{ID: raft.ServerID(leader.peerId), Address: transports[0].LocalAddr()},
+	}}).Error(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "leader", func() bool { return leader.raft.State() == raft.Leader })
+	for i, s := range nodes[1:] {
+		if err := leader.raft.AddVoter(raft.ServerID(s.peerId), transports[i+1].LocalAddr(), 0, 0).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestHttpCluster runs newTestClusterOf with every node serving its routes on the HTTP port of its peer ID.
+func newTestHttpCluster(t *testing.T, n int) ([]*Server, []*WebHandler) {
+	return newTestWebCluster(t, n, nil)
+}
+
+// newTestWebCluster is newTestHttpCluster over HTTPS with client certificates when pki is set, each
+// node holding a certificate of pki for 127.0.0.1.
+func newTestWebCluster(t *testing.T, n int, pki *testPki) ([]*Server, []*WebHandler) {
+	listeners := make([]net.Listener, n)
+	peerIds := make([]string, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+		peerIds[i] = fmt.Sprintf("127.0.0.1:%d:%d", 9090+i, l.Addr().(*net.TCPAddr).Port)
+	}
+	nodes := newTestClusterOf(t, peerIds...)
+	handlers := make([]*WebHandler, n)
+	for i, s := range nodes {
+		if pki != nil {
+			s.https = pki.issue(t, fmt.Sprintf("node%d", i), pki, "127.0.0.1")
+			s.client.Transport = s.https.HttpTransport()
+			listeners[i] = tls.NewListener(listeners[i], s.https.HttpsConfig(tls.RequireAndVerifyClientCert))
+		}
+		handlers[i] = NewWebHandler(s, 100, time.Second)
+		mux := http.NewServeMux()
+		var handler http.Handler = mux
+		for _, r := range handlers[i].Routes() {
+			route := Access(r.Path, nil, Handled(r.Handler))
+			if strings.HasSuffix(r.Path, "/") {
+				handler = ServePrefix(r.Path, route, handler)
+			} else {
+				mux.HandleFunc(r.Path, route)
+			}
+		}
+		web := &http.Server{Handler: handler}
+		go web.Serve(listeners[i])
+		t.Cleanup(func() { web.Close() })
+	}
+	for _, s := range nodes[1:] {
+		follower := s
+		waitFor(t, "a known leader", func() bool { _, err := follower.leaderId(); return err == nil })
+	}
+	return nodes, handlers
+}
+
+// waitFor fails unless ok holds within a few seconds.
+func waitFor(t *testing.T, what string, ok func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !ok(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestAutopilotStaging checks that autopilot only promotes the servers which joined as voters, on any
+// leader, and not once they are demoted.
+func TestAutopilotStaging(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	leader, demoted := nodes[0], nodes[1].peerId
+	leader.autopilot = NewAutopilot(leader, time.Minute, 0, 1)
+	o := &VpOrigin{Principal: "ops"}
+	if err := leader.raftApply(&VpLogCmd{Op: CMDSTAGE, Key: demoted, Origin: o}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.RaftDemote(demoted, o); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		peerId   string
+		nonVoter bool
+	}{{"voter:9090:8080", false}, {"replica:9090:8080", true}} {
+		if err := leader.RaftJoin(c.peerId, c.nonVoter, o); err != nil {
+			t.Fatal(err)
+		}
+		if suffrage, err := leader.suffrageOf(c.peerId); err != nil || suffrage != raft.Nonvoter {
+			t.Errorf("%s joined as %v (%v), want a non-voter", c.peerId, suffrage, err)
+		}
+	}
+	servers, err := leader.autopilot.servers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stable := leader.autopilot.stableNonvoters(servers)
+	if len(stable) != 1 || stable[0].ID != "voter:9090:8080" {
+		t.Errorf("candidates %v, want the server which joined as a voter only", stable)
+	}
+
+	follower := nodes[1].store
+	waitFor(t, "the staging on the follower", func() bool {
+		staged, _ := follower.IsStaged("voter:9090:8080")
+		return staged
+	})
+	for peerId, want := range map[string]bool{demoted: false, "replica:9090:8080": false} {
+		if staged, err := follower.IsStaged(peerId); err != nil || staged != want {
+			t.Errorf("%s: staged %v (%v), want %v", peerId, staged, err, want)
+		}
+	}
+}
+
+// TestStopLeave checks that stopping nodes with leave removes them from the configuration, through
+// the leader for a follower.
+func TestStopLeave(t *testing.T) {
+	nodes, _ := newTestHttpCluster(t, 3)
+	leader, follower, last := nodes[0], nodes[1], nodes[2]
+	if err := follower.Stop(true); err != nil {
+		t.Fatal(err)
+	}
+	if leader.isPeerId(follower.peerId) {
+		t.Error("follower still in the configuration")
+	}
+	if err := leader.Stop(true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the last node's leadership", func() bool { return last.raft.State() == raft.Leader })
+	if last.isPeerId(leader.peerId) || !last.isPeerId(last.peerId) {
+		t.Error("leader still in the configuration")
+	}
+}
+
+// TestStopTransfer checks that a leader stopping without leaving hands its leadership over.
+func TestStopTransfer(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	if err := nodes[0].Stop(false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a new leader", func() bool {
+		return nodes[1].raft.State() == raft.Leader || nodes[2].raft.State() == raft.Leader
+	})
+	if !nodes[1].isPeerId(nodes[0].peerId) {
+		t.Error("stopped leader removed from the configuration")
+	}
+}
+
+// getFrom sends a GET request to the HTTP port of s, and returns the status of the response.
+func getFrom(t *testing.T, s *Server, uri string) int {
+	res, err := http.Get(s.peerHttp(s.peerId) + uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+// TestTransferRequest checks leadership transfers to a given peer, through a follower, and to any peer.
+func TestTransferRequest(t *testing.T) {
+	nodes, _ := newTestHttpCluster(t, 3)
+	target := nodes[2]
+	if code := getFrom(t, nodes[1], RRfXfer+"?peerId="+url.QueryEscape(target.peerId)); code != http.StatusOK {
+		t.Fatalf("transfer through a follower: %d", code)
+	}
+	waitFor(t, "the target's leadership", func() bool { return target.raft.State() == raft.Leader })
+	if code := getFrom(t, target, RRfXfer); code != http.StatusOK {
+		t.Fatalf("transfer to any peer: %d", code)
+	}
+	waitFor(t, "another leader", func() bool {
+		return nodes[0].raft.State() == raft.Leader || nodes[1].raft.State() == raft.Leader
+	})
+	if code := getFrom(t, nodes[0], RRfXfer+"?peerId=unknown:9090:8080"); code != http.StatusInternalServerError {
+		t.Errorf("transfer to an unknown peer: %d", code)
+	}
+}
+
+// TestSuffrageChanges checks joins of non-voters, and promotions and demotions of existing members only.
+func TestSuffrageChanges(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	leader, member := nodes[0], nodes[1]
+	o := &VpOrigin{Principal: "ops"}
+	if err := leader.RaftPromote(member.peerId, o); err == nil {
+		t.Error("voter promoted")
+	}
+	if err := leader.RaftDemote(member.peerId, o); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the demotion on the member", func() bool { return member.RaftStats()["suffrage"] == raft.Nonvoter.String() })
+	if err := leader.RaftDemote(member.peerId, o); err == nil {
+		t.Error("non-voter demoted")
+	}
+	if err := member.RaftPromote(member.peerId, o); err == nil {
+		t.Error("promotion by a follower")
+	}
+	if err := leader.RaftPromote(member.peerId, o); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.RaftJoin("replica:9090:8080", true, o); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.RaftPromote("unknown:9090:8080", o); err == nil {
+		t.Error("unknown peer promoted")
+	}
+	for peerId, want := range map[string]raft.ServerSuffrage{member.peerId: raft.Voter, "replica:9090:8080": raft.Nonvoter} {
+		if suffrage, err := leader.suffrageOf(peerId); err != nil || suffrage != want {
+			t.Errorf("%s: %v (%v), want %v", peerId, suffrage, err, want)
+		}
+	}
+	details := make([]string, 0)
+	for _, e := range auditOf(t, leader.store) {
+		details = append(details, strings.SplitN(e.Detail, ",", 2)[0])
+	}
+	if strings.Join(details, "/") != "demote/promote/join non-voter" {
+		t.Errorf("audited %v", details)
+	}
+}
+
+// TestAutopilotPruning checks that dead servers are removed, without shrinking the voters below minQuorum.
+func TestAutopilotPruning(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	leader, dead := nodes[0], raft.ServerID(nodes[2].peerId)
+	a := NewAutopilot(leader, time.Minute, time.Minute, 3)
+	leader.autopilot = a
+	failed := func(id raft.ServerID, since time.Duration) {
+		a.observe(raft.Observation{Data: raft.FailedHeartbeatObservation{PeerID: id, LastContact: time.Now().Add(-since)}})
+	}
+	failed(dead, time.Hour)
+	failed(raft.ServerID(nodes[1].peerId), time.Second) // not for long enough
+	health, err := a.Health()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range health {
+		if h.Healthy != (h.ID == leader.peerId) {
+			t.Errorf("%s: healthy %v", h.ID, h.Healthy)
+		}
+	}
+	a.pruneDeadServers()
+	if !leader.isPeerId(string(dead)) {
+		t.Error("dead voter removed below the minimum quorum")
+	}
+	a.minQuorum = 2
+	a.pruneDeadServers()
+	if leader.isPeerId(string(dead)) || !leader.isPeerId(nodes[1].peerId) {
+		t.Error("only the dead voter must be removed")
+	}
+	a.observe(raft.Observation{Data: raft.ResumedHeartbeatObservation{PeerID: raft.ServerID(nodes[1].peerId)}})
+	if health, _ := a.Health(); len(health) != 2 || !health[0].Healthy || !health[1].Healthy {
+		t.Errorf("health %+v, want both servers healthy", health)
+	}
+}
+
+// TestRaftMembers checks the members listed by the leader, with the log of its followers, and by a follower.
+func TestRaftMembers(t *testing.T) {
+	nodes, _ := newTestHttpCluster(t, 3)
+	leader := nodes[0]
+	if err := leader.RaftJoin("127.0.0.1:9099:1", true, &VpOrigin{Principal: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	members, err := leader.RaftMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 4 {
+		t.Fatalf("%d members, want 4", len(members))
+	}
+	for i, m := range members {
+		reachable := i < len(nodes)
+		if m.Leader != (i == 0) || m.Suffrage != map[bool]string{true: "Voter", false: "Nonvoter"}[reachable] {
+			t.Errorf("%s: leader %v, %s", m.ID, m.Leader, m.Suffrage)
+		}
+		if reachable && (m.LastLogIndex == 0 || m.Error != "") || !reachable && m.Error == "" {
+			t.Errorf("%s: last log index %d, error %q", m.ID, m.LastLogIndex, m.Error)
+		}
+		if port := m.ID[strings.LastIndex(m.ID, ":"):]; m.Http != "http://127.0.0.1"+port {
+			t.Errorf("%s: http %s", m.ID, m.Http)
+		}
+	}
+	members, err = nodes[1].RaftMembers()
+	if err != nil || len(members) != 4 || !members[0].Leader || members[1].LastLogIndex != 0 {
+		t.Errorf("members on a follower %+v, %v", members, err)
+	}
+}
+
+// TestClusterStatus checks the status of every node, gathered by a follower, including an unreachable one.
+func TestClusterStatus(t *testing.T) {
+	nodes, _ := newTestHttpCluster(t, 3)
+	if err := nodes[0].RaftJoin("127.0.0.1:9099:1", true, &VpOrigin{Principal: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the configuration on the follower", func() bool { return nodes[2].isPeerId("127.0.0.1:9099:1") })
+	res, err := http.Get(nodes[2].peerHttp(nodes[2].peerId) + RRfClst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var status []VpNodeStatus
+	if err := json.NewDecoder(res.Body).Decode(&VpResponse{Data: &status}); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("%d, %v", res.StatusCode, err)
+	}
+	if len(status) != 4 {
+		t.Fatalf("%d nodes, want 4", len(status))
+	}
+	for i, n := range status {
+		want := map[bool]string{true: "Leader", false: "Follower"}[i == 0]
+		if i < len(nodes) && (!n.Reachable || n.State != want || n.Term != status[0].Term || n.AppliedIndex == 0) {
+			t.Errorf("%s: %+v, want a reachable %s", n.ID, n, want)
+		}
+		if i == len(nodes) && (n.Reachable || n.Error == "") {
+			t.Errorf("%s: %+v, want unreachable", n.ID, n)
+		}
+	}
+}
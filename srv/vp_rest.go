@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	RV1Kv           = "/v1/kv/"
+	HETag           = "ETag"
+	HIfMatch        = "If-Match"
+	HIfNoneMatch    = "If-None-Match"
+	HAllow          = "Allow"
+	HContentLength  = "Content-Length"
+	VOctetStream    = "application/octet-stream"
+	V1KvMethods     = "GET, HEAD, PUT, DELETE"
+	ETagHashSize    = 16 // bytes of the SHA-256 of values used as ETag
+	AnyETag         = "*"
+	WeakETagPrefix  = "W/"
+	MaxV1KeyPathLen = 4096
+)
+
+var (
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrMissingKey         = errors.New("missing key")
+)
+
+// VpCondition makes a write depend on the current value of its key, as checked when applied.
+type VpCondition struct {
+	IfMatch     string // the value must have one of these ETags, or exist for *
+	IfNoneMatch string // the value must have none of these ETags, or not exist for *
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+// etagOf is a strong validator of a value, i.e. of its content.
+func etagOf(value []byte) string {
+	sum := sha256.Sum256(value)
+	return `"` + hex.EncodeToString(sum[:ETagHashSize]) + `"`
+}
+
+/*
+	etagMatches tells whether the ETag of the current value, empty when there is none, is one
+	of the comma separated ETags of an If-Match or If-None-Match header, or any value for *.
+	If-Match uses the strong comparison, which never matches weak ETags, If-None-Match the weak one.
+*/
+func etagMatches(header string, etag string, weak bool) bool {
+	if len(etag) == 0 {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, WeakETagPrefix)
+		}
+		if candidate == AnyETag || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// v1KeyOf reads the key of a /v1/kv request from its escaped path, so that keys can hold any byte.
+func v1KeyOf(req *http.Request) (string, error) {
+	path := req.URL.EscapedPath()
+	if !strings.HasPrefix(path, RV1Kv) || len(path) > MaxV1KeyPathLen {
+		return "", ErrMissingKey
+	}
+	key, err := url.PathUnescape(path[len(RV1Kv):])
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		return "", ErrMissingKey
+	}
+	return key, nil
+}
+
+// v1KeyAccess authorizes /v1/kv requests on the key of their path, for reading or writing by method.
+func v1KeyAccess(p *VpPrincipal, req *http.Request) bool {
+	key, err := v1KeyOf(req)
+	if err != nil {
+		return true // answered as a bad request by the handler
+	}
+	right := AclRead
+	if req.Method == Put || req.Method == Delete {
+		right = AclWrite
+	}
+	return p.KeyAllowed(key, right)
+}
+
+// conditionOf reads the preconditions of a write request, if any.
+func conditionOf(req *http.Request) *VpCondition {
+	c := VpCondition{IfMatch: req.Header.Get(HIfMatch), IfNoneMatch: req.Header.Get(HIfNoneMatch)}
+	if len(c.IfMatch) == 0 && len(c.IfNoneMatch) == 0 {
+		return nil
+	}
+	return &c
+}
+
+// preconditionOf checks the condition of a command against the current value of its key.
+func preconditionOf(txn *badger.Txn, cmd *VpLogCmd) error {
+	if cmd.Cond == nil {
+		return nil
+	}
+	etag := ""
+	item, err := txn.Get(dataKeyOf([]byte(cmd.Key)))
+	if err == nil {
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if len(value) > 0 { // like GetRequest, empty values are missing
+			etag = etagOf(value)
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	if len(cmd.Cond.IfMatch) > 0 && !etagMatches(cmd.Cond.IfMatch, etag, false) {
+		return ErrPreconditionFailed
+	}
+	if len(cmd.Cond.IfNoneMatch) > 0 && etagMatches(cmd.Cond.IfNoneMatch, etag, true) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+/* ==================================================================================
+                            Request methods
+================================================================================== */
+
+/*
+	V1KvRequest serves /v1/kv/{key}: GET and HEAD read the raw value, with its ETag and a 304
+	answer when it matches If-None-Match, PUT sets the raw body as value and DELETE removes the
+	key, both optionally conditional on If-Match or If-None-Match. Errors are JSON VpResponses.
+*/
+func (h *WebHandler) V1KvRequest(w http.ResponseWriter, req *http.Request) {
+	key, err := v1KeyOf(req)
+	if err != nil {
+		onError(w, err, http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case Get, Head:
+		h.v1Read(w, req, key)
+	case Put, Delete:
+		h.v1Write(w, req, key)
+	default:
+		w.Header().Set(HAllow, V1KvMethods)
+		onError(w, fmt.Errorf("method not allowed: [%s]", req.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *WebHandler) v1Read(w http.ResponseWriter, req *http.Request, key string) {
+	data, err := h.s.store.GetData([]byte(key))
+	if (err == nil || err == ErrKeyNotFound) && len(data) == 0 {
+		onError(w, fmt.Errorf("key not found: [%s]", key), http.StatusNotFound)
+		return
+	} else if err != nil {
+		onError(w, err, http.StatusInternalServerError)
+		return
+	}
+	etag := etagOf(data)
+	w.Header().Set(HETag, etag)
+	if inm := req.Header.Get(HIfNoneMatch); len(inm) > 0 && etagMatches(inm, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set(HContentType, VOctetStream)
+	w.Header().Set(HContentLength, strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method != Head {
+		w.Write(data)
+	}
+}
+
+func (h *WebHandler) v1Write(w http.ResponseWriter, req *http.Request, key string) {
+	if h.leaderOnly() {
+		h.forwardToLeader(w, req)
+		return
+	}
+	if !h.admit(w, req, 1) {
+		return
+	}
+	wr, ctx, cancel, err := h.writeOf(req)
+	if err != nil {
+		onError(w, err, http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	wr.Cond = conditionOf(req)
+	if req.Method == Delete {
+		err = h.s.RaftDelete(ctx, key, wr, h.originOf(req))
+	} else {
+		req.Body = http.MaxBytesReader(w, req.Body, MaxUploadSizeMb)
+		var value []byte
+		if value, err = readTo(req.Body); err != nil {
+			onError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err = h.s.RaftSet(ctx, key, value, wr, h.originOf(req)); err == nil && !wr.Async {
+			w.Header().Set(HETag, etagOf(value))
+		}
+	}
+	if err != nil {
+		onWriteError(w, err)
+	} else {
+		onWritten(w, req, wr, key)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func newTestStore(t *testing.T) *BadgerStore {
+	store, _ := NewBadgerStore(t.TempDir())
+	if !store.IsOpen() {
+		t.Fatal("failed to open the store")
+	}
+	t.Cleanup(func() {
+		if store.IsOpen() { // unless closed by the test, e.g. with its server
+			store.Close()
+		}
+	})
+	return store
+}
+
+// applyCmd applies a command to the state machine as raft would, at index.
+func applyCmd(t *testing.T, store *BadgerStore, index uint64, cmd *VpLogCmd) *VpRpcResponse {
+	return applyCmdAt(t, store, index, cmd, time.Now())
+}
+
+func encodeCmd(t *testing.T, cmd *VpLogCmd) []byte {
+	buff, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buff
+}
+
+// applyCmdAt applies a command appended to the log by the leader at the given time.
+func applyCmdAt(t *testing.T, store *BadgerStore, index uint64, cmd *VpLogCmd, at time.Time) *VpRpcResponse {
+	buff := encodeCmd(t, cmd)
+	res, _ := store.Apply(&raft.Log{Index: index, Type: raft.LogCommand, Data: buff, AppendedAt: at}).(*VpRpcResponse)
+	if res == nil {
+		t.Fatalf("no response to %s at %d", cmd.Op, index)
+	}
+	return res
+}
+
+// TestServePrefixKeys checks that /v1/kv keys reach the handler as sent, rather than cleaned by the mux.
+func TestServePrefixKeys(t *testing.T) {
+	keyOf := func(w http.ResponseWriter, req *http.Request) {
+		key, err := v1KeyOf(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(key))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(RV1Kv, keyOf)
+	mux.HandleFunc(RKvGet, func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("kv")) })
+	handler := ServePrefix(RV1Kv, keyOf, mux)
+	for path, want := range map[string]string{
+		"/v1/kv/a":          "a",
+		"/v1/kv/a%2F%2Fb":   "a//b",
+		"/v1/kv/a//b":       "a//b",
+		"/v1/kv/a%2F..%2Fb": "a/../b",
+		"/v1/kv/a/../b":     "a/../b",
+		"/v1/kv/%2E":        ".",
+		"/v1/kv/.":          ".",
+		"/v1/kv/a%20b%3F":   "a b?",
+		"/v1/kv/a%2Fb/":     "a/b/",
+		RKvGet:              "kv",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(Get, path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%s: %d %q, want %q", path, w.Code, w.Body.String(), want)
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(Get, RV1Kv, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("%s without key: %d", RV1Kv, w.Code)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	etag := etagOf([]byte("v"))
+	for _, c := range []struct {
+		header, etag string
+		weak, want   bool
+	}{
+		{etag, etag, false, true},
+		{`"other", ` + etag, etag, false, true},
+		{`"other"`, etag, false, false},
+		{AnyETag, etag, false, true},
+		{AnyETag, "", false, false},
+		{WeakETagPrefix + etag, etag, false, false},
+		{WeakETagPrefix + etag, etag, true, true},
+	} {
+		if got := etagMatches(c.header, c.etag, c.weak); got != c.want {
+			t.Errorf("etagMatches(%q, %q, %v) = %v", c.header, c.etag, c.weak, got)
+		}
+	}
+}
+
+func TestV1ReadConditional(t *testing.T) {
+	store := newTestStore(t)
+	h := NewWebHandler(&Server{store: store}, 0, 0)
+	applyCmd(t, store, 1, &VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("v")})
+	etag := etagOf([]byte("v"))
+	for _, c := range []struct {
+		key, ifNoneMatch string
+		status           int
+	}{
+		{"a", "", http.StatusOK},
+		{"a", etag, http.StatusNotModified},
+		{"a", WeakETagPrefix + etag, http.StatusNotModified},
+		{"a", AnyETag, http.StatusNotModified},
+		{"a", `"other"`, http.StatusOK},
+		{"missing", "", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(Get, RV1Kv+c.key, nil)
+		if len(c.ifNoneMatch) > 0 {
+			req.Header.Set(HIfNoneMatch, c.ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.V1KvRequest(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s, If-None-Match %q: %d, want %d", c.key, c.ifNoneMatch, w.Code, c.status)
+		}
+		if c.status == http.StatusOK && (w.Header().Get(HETag) != etag || w.Body.String() != "v") {
+			t.Errorf("%s: ETag %s, body %q", c.key, w.Header().Get(HETag), w.Body.String())
+		}
+	}
+}
+
+// TestConditionalWrites checks the preconditions as applied by the state machine, and their 412 answer.
+func TestConditionalWrites(t *testing.T) {
+	store := newTestStore(t)
+	etag := etagOf([]byte("v1"))
+	for i, c := range []struct {
+		cmd    VpLogCmd
+		failed bool
+	}{
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("v0"), Cond: &VpCondition{IfMatch: AnyETag}}, true},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("v1"), Cond: &VpCondition{IfNoneMatch: AnyETag}}, false},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("v2"), Cond: &VpCondition{IfNoneMatch: AnyETag}}, true},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("v2"), Cond: &VpCondition{IfMatch: `"other"`}}, true},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("v2"), Cond: &VpCondition{IfMatch: WeakETagPrefix + etag}}, true},
+		{VpLogCmd{Op: CMDDEL, Key: "a", Cond: &VpCondition{IfNoneMatch: etag}}, true},
+		{VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("v2"), Cond: &VpCondition{IfMatch: etag}}, false},
+		{VpLogCmd{Op: CMDDEL, Key: "a", Cond: &VpCondition{IfMatch: etag}}, true},
+		{VpLogCmd{Op: CMDDEL, Key: "a", Cond: &VpCondition{IfMatch: etagOf([]byte("v2"))}}, false},
+	} {
+		res := applyCmd(t, store, uint64(i+1), &c.cmd)
+		if failed := res.Error == ErrPreconditionFailed; failed != c.failed {
+			t.Errorf("%d: %s %+v: error %v", i, c.cmd.Op, *c.cmd.Cond, res.Error)
+		}
+	}
+	if _, err := store.GetData([]byte("a")); err != ErrKeyNotFound {
+		t.Errorf("key left after its conditional delete: %v", err)
+	}
+	if status := writeStatusOf(ErrPreconditionFailed); status != http.StatusPreconditionFailed {
+		t.Errorf("status %d, want 412", status)
+	}
+}
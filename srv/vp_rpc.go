@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	RpcMagic       = 'V' // first byte of vephar RPC connections; raft's own RPC types are 0 to 3
+	RpcPeekTimeout = 10 * time.Second
+	RpcMaxIdle     = 4 // pooled connections to the leader
+)
+
+var (
+	ErrRpcClosed = errors.New("rpc listener closed")
+)
+
+// VpRpcRequest submits a log command to the leader, with the credentials of the client which sent it.
+type VpRpcRequest struct {
+	Command   []byte
+	Trace     string
+	TimeoutMs int64
+	Async     bool // answer once appended to the log, rather than applied
+	Token     string
+	Session   string
+}
+
+type VpRpcReply struct {
+	Error     string
+	NotLeader bool
+	Index     uint64
+	Data      []byte
+	Replayed  bool
+	Leader    string `json:"-"` // raft address the reply came from
+}
+
+/* ==================================================================================
+                            Stream layers
+================================================================================== */
+
+// TcpStreamLayer is a plain TCP raft.StreamLayer, like the one of raft.NewTCPTransport.
+type TcpStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+}
+
+func NewTcpStreamLayer(bind string, advertise net.Addr) (*TcpStreamLayer, error) {
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	return &TcpStreamLayer{Listener: ln, advertise: advertise}, nil
+}
+
+func (l *TcpStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", string(address), timeout)
+}
+
+func (l *TcpStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+// peekedConn gives back the first byte read from a connection.
+type peekedConn struct {
+	net.Conn
+	first []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.first) > 0 && len(b) > 0 {
+		b[0], c.first = c.first[0], nil
+		return 1, nil
+	}
+	return c.Conn.Read(b)
+}
+
+/*
+	MuxStreamLayer shares the raft port, and its TLS configuration, with vephar's own RPCs.
+	Connections whose first byte is RpcMagic are handed to the RPC server, others to raft.
+*/
+type MuxStreamLayer struct {
+	raft.StreamLayer
+	raftConns chan net.Conn
+	rpcConns  chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMuxStreamLayer(inner raft.StreamLayer) *MuxStreamLayer {
+	m := &MuxStreamLayer{
+		StreamLayer: inner,
+		raftConns:   make(chan net.Conn), rpcConns: make(chan net.Conn), done: make(chan struct{}),
+	}
+	go m.acceptLoop()
+	return m
+}
+
+func (m *MuxStreamLayer) acceptLoop() {
+	for {
+		conn, err := m.StreamLayer.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			log.Warn("raft listener error", "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go m.route(conn)
+	}
+}
+
+func (m *MuxStreamLayer) route(conn net.Conn) {
+	first := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(RpcPeekTimeout))
+	if _, err := io.ReadFull(conn, first); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	target, c := m.raftConns, net.Conn(&peekedConn{Conn: conn, first: first})
+	if first[0] == RpcMagic {
+		target, c = m.rpcConns, conn
+	}
+	select {
+	case target <- c:
+	case <-m.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next raft connection.
+func (m *MuxStreamLayer) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.raftConns:
+		return c, nil
+	case <-m.done:
+		return nil, ErrRpcClosed
+	}
+}
+
+func (m *MuxStreamLayer) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+	return m.StreamLayer.Close()
+}
+
+/* ==================================================================================
+                            RPC
+================================================================================== */
+
+type rpcConn struct {
+	net.Conn
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+/*
+	Rpc lets followers submit log commands to the leader's raft.Apply over the raft port. It is
+	only started with mutual TLS, so that connections are authenticated like raft's own. The leader
+	only accepts data writes, and authorizes them again with the client's credentials, rather than
+	trusting the follower's HTTP handler and the principal of the command's origin.
+*/
+type Rpc struct {
+	s    *Server
+	mux  *MuxStreamLayer
+	mu   sync.Mutex
+	idle map[raft.ServerAddress][]*rpcConn
+}
+
+func NewRpc(s *Server, mux *MuxStreamLayer) *Rpc {
+	r := &Rpc{s: s, mux: mux, idle: make(map[raft.ServerAddress][]*rpcConn)}
+	go r.serve()
+	return r
+}
+
+func (r *Rpc) serve() {
+	for {
+		select {
+		case conn := <-r.mux.rpcConns:
+			go r.serveConn(conn)
+		case <-r.mux.done:
+			return
+		}
+	}
+}
+
+func (r *Rpc) serveConn(conn net.Conn) {
+	defer conn.Close()
+	dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		req := VpRpcRequest{}
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				log.Debug("rpc connection closed", "remote", conn.RemoteAddr(), "error", err)
+			}
+			return
+		}
+		if err := enc.Encode(r.apply(&req)); err != nil {
+			log.Warn("rpc reply failed", "remote", conn.RemoteAddr(), "error", err)
+			return
+		}
+	}
+}
+
+func (r *Rpc) apply(req *VpRpcRequest) *VpRpcReply {
+	if r.s.raft.State() != raft.Leader {
+		return &VpRpcReply{NotLeader: true, Error: ErrNotLeader.Error()}
+	}
+	span := StartRemoteSpan(req.Trace, "rpc.apply", SpanServer)
+	defer span.End()
+	metrics.IncrCounter([]string{"rpc", "apply"}, 1)
+	cmd := VpLogCmd{}
+	if err := json.Unmarshal(req.Command, &cmd); err != nil {
+		return &VpRpcReply{Error: err.Error()}
+	}
+	buff, err := r.authorize(&cmd, req)
+	if err != nil {
+		span.SetError(err)
+		return &VpRpcReply{Error: err.Error()}
+	}
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	index, res, err := r.s.leaderApply(ctx, &cmd, buff, req.Async, timeout)
+	if err != nil {
+		span.SetError(err)
+		return &VpRpcReply{Error: err.Error(), NotLeader: err == raft.ErrNotLeader || err == raft.ErrLeadershipLost}
+	}
+	reply := &VpRpcReply{Index: index}
+	if res != nil {
+		reply.Data, reply.Replayed = res.Data, res.Replayed
+		if res.Error != nil {
+			reply.Error = res.Error.Error()
+		}
+	}
+	return reply
+}
+
+/*
+	authorize accepts sets and deletes of keys, alone or in a batch, which the client may write.
+	The principal of the command's origin is replaced by the one of the client's credentials, and
+	the command is encoded again.
+*/
+func (r *Rpc) authorize(cmd *VpLogCmd, req *VpRpcRequest) ([]byte, error) {
+	cmds := []VpLogCmd{*cmd}
+	if cmd.Op == CMDBATCH {
+		cmds = cmd.Batch
+	}
+	for _, c := range cmds {
+		if c.Op != CMDSET && c.Op != CMDDEL {
+			return nil, fmt.Errorf("rpc: command not allowed: [%s]", c.Op)
+		}
+	}
+	if !r.s.AclEnabled() {
+		return req.Command, nil
+	}
+	p, err := r.s.PrincipalOfCredentials(req.Token, req.Session)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cmds {
+		if !p.KeyAllowed(c.Key, AclWrite) {
+			return nil, ErrAclDenied
+		}
+	}
+	setPrincipal(cmd, p.Name)
+	return json.Marshal(cmd)
+}
+
+func setPrincipal(cmd *VpLogCmd, name string) {
+	if cmd.Origin != nil {
+		o := *cmd.Origin
+		o.Principal = name
+		cmd.Origin = &o
+	}
+	for i := range cmd.Batch {
+		setPrincipal(&cmd.Batch[i], name)
+	}
+}
+
+func (r *Rpc) conn(leader raft.ServerAddress, timeout time.Duration) (*rpcConn, error) {
+	r.mu.Lock()
+	if pool := r.idle[leader]; len(pool) > 0 {
+		c := pool[len(pool)-1]
+		r.idle[leader] = pool[:len(pool)-1]
+		r.mu.Unlock()
+		return c, nil
+	}
+	r.mu.Unlock()
+	conn, err := r.mux.Dial(leader, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{RpcMagic}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &rpcConn{Conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}, nil
+}
+
+func (r *Rpc) release(leader raft.ServerAddress, c *rpcConn) {
+	c.SetDeadline(time.Time{})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle[leader]) >= RpcMaxIdle {
+		c.Close()
+		return
+	}
+	r.idle[leader] = append(r.idle[leader], c)
+}
+
+/*
+	Apply submits a command to the current leader and waits for its result. It retries while no
+	leader is known, the leader can't be dialed, or the node it reached is no longer the leader.
+	Once a request was sent, failures are returned as is, since the command may have been applied,
+	unless the command is idempotent, i.e. carries an idempotency key. It gives up when ctx is done.
+*/
+func (r *Rpc) Apply(ctx context.Context, req *VpRpcRequest, idempotent bool) (*VpRpcReply, error) {
+	deadline := time.Now().Add(time.Duration(req.TimeoutMs) * time.Millisecond)
+	delay := ForwardRetryDelay
+	for attempt := 0; ; attempt++ {
+		var err error
+		if leader := r.s.raft.Leader(); len(leader) == 0 {
+			err = ErrNoLeader
+		} else if c, dialErr := r.conn(leader, time.Until(deadline)); dialErr != nil {
+			err = dialErr
+		} else {
+			c.SetDeadline(deadline)
+			reply := VpRpcReply{}
+			sent := make(chan struct{})
+			go func() { // unblocks the exchange when ctx is done
+				select {
+				case <-ctx.Done():
+					c.SetDeadline(time.Now())
+				case <-sent:
+				}
+			}()
+			if err = c.enc.Encode(req); err == nil {
+				err = c.dec.Decode(&reply)
+			}
+			close(sent)
+			if ctx.Err() != nil {
+				c.Close()
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				c.Close()
+				if !idempotent {
+					return nil, err
+				}
+			} else {
+				r.release(leader, c)
+				reply.Leader = string(leader)
+				if !reply.NotLeader {
+					return &reply, nil
+				}
+				err = errors.New(reply.Error)
+			}
+		}
+		if attempt >= ForwardRetries || time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		log.Warn("retrying rpc apply", "attempt", attempt, "error", err)
+		metrics.IncrCounter([]string{"rpc", "retries"}, 1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
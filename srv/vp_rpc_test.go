@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// newTestRpcCluster runs n voters over TCP on localhost, each with RPC sharing its raft port.
+func newTestRpcCluster(t *testing.T, n int) []*Server {
+	nodes := make([]*Server, n)
+	transports := make([]raft.Transport, n)
+	for i := range nodes {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := NewMuxStreamLayer(&TcpStreamLayer{Listener: ln, advertise: ln.Addr()})
+		nodes[i] = NewServer("", fmt.Sprintf("%s:8080", ln.Addr()), nil, false)
+		nodes[i].rpc = NewRpc(nodes[i], mux)
+		trans := raft.NewNetworkTransport(mux, 3, time.Second, io.Discard)
+		t.Cleanup(func() { trans.Close() })
+		transports[i] = trans
+	}
+	startTestCluster(t, nodes, transports)
+	return nodes
+}
+
+// TestRpcApply checks that followers submit writes to the leader over RPC, synchronous or not.
+func TestRpcApply(t *testing.T) {
+	nodes := newTestRpcCluster(t, 2)
+	leader, follower := nodes[0], nodes[1]
+	waitFor(t, "a known leader", func() bool { return len(follower.raft.Leader()) > 0 })
+	wr := &VpWrite{}
+	if err := follower.RaftSet(context.Background(), "a", []byte("b"), wr, &VpOrigin{Principal: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	if v := valueOf(t, leader.store, "a"); v != "b" || wr.Index == 0 {
+		t.Errorf("value %q on the leader, at index %d", v, wr.Index)
+	}
+	async := &VpWrite{Async: true}
+	if err := follower.RaftDelete(context.Background(), "a", async, &VpOrigin{Principal: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	if async.Index <= wr.Index {
+		t.Errorf("async write at index %d, after %d", async.Index, wr.Index)
+	}
+	waitFor(t, "the delete on the follower", func() bool { return valueOf(t, follower.store, "a") == "" })
+
+	if reply := follower.rpc.apply(&VpRpcRequest{}); !reply.NotLeader {
+		t.Errorf("follower applied a command: %+v", reply)
+	}
+	buff, err := json.Marshal(&VpLogCmd{Op: CMDMEMBER, Key: "x:9090:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := follower.rpc.Apply(context.Background(), &VpRpcRequest{Command: buff, TimeoutMs: 1000}, false)
+	if err != nil || !strings.Contains(reply.Error, "not allowed") {
+		t.Errorf("membership change over RPC: %+v, %v", reply, err)
+	}
+}
+
+// TestRpcAuthorize checks that the leader authorizes writes with the credentials of the client.
+func TestRpcAuthorize(t *testing.T) {
+	nodes := newTestRpcCluster(t, 2)
+	leader, follower := nodes[0], nodes[1]
+	leader.aclMaster = testMaster
+	waitFor(t, "a known leader", func() bool { return len(follower.raft.Leader()) > 0 })
+	o := &VpOrigin{Principal: AclMaster}
+	if err := follower.RaftSet(context.Background(), "a", []byte("b"), &VpWrite{}, o); err == nil || err.Error() != ErrAclDenied.Error() {
+		t.Errorf("anonymous write: %v", err)
+	}
+	if err := follower.RaftSet(context.Background(), "a", []byte("b"), &VpWrite{Token: "wrong"}, o); err == nil {
+		t.Error("write with an unknown token")
+	}
+	if err := follower.RaftSet(context.Background(), "a", []byte("b"), &VpWrite{Token: testMaster}, o); err != nil {
+		t.Errorf("write with the master token: %v", err)
+	}
+	if v := valueOf(t, leader.store, "a"); v != "b" {
+		t.Errorf("value %q on the leader", v)
+	}
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	CSession        = "vp_session"
+	COidcState      = "vp_oidc"
+	AclUserKind     = "user/"
+	OidcUserPrefix  = "oidc:" // of the user entries of OIDC identities, apart from local users
+	SessionLocal    = "local"
+	SessionOidc     = "oidc"
+	OidcStateTtl    = 10 * time.Minute
+	OidcCacheTtl    = time.Hour
+	OidcHttpTimeout = 10 * time.Second
+)
+
+const (
+	RAuthLogin    = "/auth/login"
+	RAuthLogout   = "/auth/logout"
+	RAuthWhoami   = "/auth/whoami"
+	RAuthOidc     = "/auth/oidc/login"
+	RAuthOidcBack = "/auth/oidc/callback"
+	RAclUsrList   = "/acl/user/list"
+	RAclUsrSet    = "/acl/user/set"
+	RAclUsrDel    = "/acl/user/del"
+)
+
+var (
+	ErrAclNoSession = errors.New("session expired or invalid")
+	ErrAclLogin     = errors.New("invalid user name or password")
+)
+
+// VpUser is a dashboard user. OIDC users are matched by their verified email (or subject)
+// prefixed with OidcUserPrefix, and only need an entry to be granted policies, without a password.
+type VpUser struct {
+	Name         string
+	Password     string `json:",omitempty"` // only accepted on input, never stored
+	PasswordHash string
+	Policies     []string
+}
+
+type VpWhoami struct {
+	Name   string
+	Oidc   bool
+	Secure bool // false when ACLs are disabled and no login is needed
+}
+
+/*
+	Sessions are stateless: the cookie carries the user name, the way it logged in and an
+	expiry, signed with a key derived from the ACL master token. Every node can verify it,
+	so forwarded requests are authorized as the same user on the leader. Policies are
+	looked up on each request, deleting a user ends its sessions.
+*/
+type Sessions struct {
+	s       *Server
+	ttl     time.Duration
+	secure  bool // set the Secure flag on cookies (HTTPS)
+	oidc    *Oidc
+	signKey []byte
+}
+
+type Oidc struct {
+	issuer, clientId, clientSecret, redirectUrl string
+
+	mu       sync.Mutex
+	loadedAt time.Time
+	authUrl  string
+	tokenUrl string
+	jwksUrl  string
+	keys     map[string]crypto.PublicKey
+	client   *http.Client
+}
+
+func NewSessions(s *Server, ttl time.Duration, secure bool, oidc *Oidc) *Sessions {
+	key := sha256.Sum256([]byte("vephar-session:" + s.aclMaster))
+	return &Sessions{s: s, ttl: ttl, secure: secure, oidc: oidc, signKey: key[:]}
+}
+
+func NewOidc(issuer, clientId, clientSecret, redirectUrl string) *Oidc {
+	return &Oidc{
+		issuer: strings.TrimSuffix(issuer, "/"), clientId: clientId,
+		clientSecret: clientSecret, redirectUrl: redirectUrl,
+		client: &http.Client{Timeout: OidcHttpTimeout},
+	}
+}
+
+/* ==================================================================================
+                            Signed cookies
+================================================================================== */
+
+// sign binds payload to purpose, the name of its cookie, so that a cookie can't stand for another.
+func (ss *Sessions) sign(purpose, payload string) string {
+	mac := hmac.New(sha256.New, ss.signKey)
+	mac.Write([]byte(purpose + "\n" + payload))
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(payload)) + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func (ss *Sessions) verify(purpose, value string) (string, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return "", ErrAclNoSession
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrAclNoSession
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrAclNoSession
+	}
+	mac := hmac.New(sha256.New, ss.signKey)
+	mac.Write([]byte(purpose + "\n"))
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", ErrAclNoSession
+	}
+	return string(payload), nil
+}
+
+/*
+	Signed payloads are "kind|name|expiry" for sessions and "state|nonce|expiry" for OIDC logins,
+	with both fields base64url encoded since names may hold a "|", e.g. auth0|123. Sessions are
+	strictly same-site, since some API routes still mutate on GET. The OIDC state has to survive
+	the redirect back from the provider.
+*/
+func (ss *Sessions) setCookie(w http.ResponseWriter, name, a, b string, ttl time.Duration, sameSite http.SameSite) {
+	exp := time.Now().Add(ttl)
+	http.SetCookie(w, &http.Cookie{
+		Name: name, Value: ss.valueOf(name, a, b, exp), Path: "/", Expires: exp,
+		HttpOnly: true, Secure: ss.secure, SameSite: sameSite,
+	})
+}
+
+func (ss *Sessions) valueOf(name, a, b string, exp time.Time) string {
+	enc := base64.RawURLEncoding
+	return ss.sign(name, fmt.Sprintf("%s|%s|%d", enc.EncodeToString([]byte(a)), enc.EncodeToString([]byte(b)), exp.Unix()))
+}
+
+func (ss *Sessions) readCookie(req *http.Request, name string) (string, string, error) {
+	c, err := req.Cookie(name)
+	if err != nil {
+		return "", "", ErrAclNoSession
+	}
+	return ss.readValue(name, c.Value)
+}
+
+// readValue verifies the value of the cookie name, and returns its two fields.
+func (ss *Sessions) readValue(name, value string) (string, string, error) {
+	payload, err := ss.verify(name, value)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(payload, "|")
+	if len(parts) != 3 {
+		return "", "", ErrAclNoSession
+	}
+	exp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return "", "", ErrAclNoSession
+	}
+	enc := base64.RawURLEncoding
+	a, errA := enc.DecodeString(parts[0])
+	b, errB := enc.DecodeString(parts[1])
+	if errA != nil || errB != nil {
+		return "", "", ErrAclNoSession
+	}
+	return string(a), string(b), nil
+}
+
+func clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+}
+
+// PrincipalOf resolves the user of a session cookie value.
+func (ss *Sessions) PrincipalOf(value string) (*VpPrincipal, error) {
+	kind, name, err := ss.readValue(CSession, value)
+	if err != nil {
+		return nil, err
+	}
+	entry := name
+	if kind == SessionOidc {
+		entry = OidcUserPrefix + name
+	}
+	usr, err := ss.s.AclUser(entry)
+	if err == ErrKeyNotFound && kind == SessionOidc {
+		return &VpPrincipal{Name: "oidc:" + name}, nil
+	} else if err != nil {
+		return nil, ErrAclNoSession
+	}
+	return ss.s.principalFor(kind+":"+name, usr.Policies), nil
+}
+
+/* ==================================================================================
+                            Users
+================================================================================== */
+
+func (s *Server) AclUser(name string) (*VpUser, error) {
+	raw, err := s.store.GetAcl([]byte(AclUserKind + name))
+	if err != nil {
+		return nil, err
+	}
+	usr := &VpUser{}
+	if err := json.Unmarshal(raw, usr); err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+func (s *Server) AclUsers() ([]VpUser, error) {
+	raws, err := s.store.AclValuesOf([]byte(AclUserKind))
+	if err != nil {
+		return nil, err
+	}
+	users := make([]VpUser, len(raws))
+	for i, raw := range raws {
+		if err := json.Unmarshal(raw, &users[i]); err != nil {
+			return nil, err
+		}
+		users[i].PasswordHash = ""
+	}
+	return users, nil
+}
+
+// RaftAclSetUser stores a user, hashing its password. Without a password, the current
+// one is kept. Users that never had one can only log in through OIDC.
+func (s *Server) RaftAclSetUser(usr *VpUser, o *VpOrigin) error {
+	if len(usr.Name) == 0 {
+		return errors.New("user name is required")
+	}
+	if strings.HasPrefix(usr.Name, OidcUserPrefix) && len(usr.Password) > 0 {
+		return errors.New("OIDC users log in through their provider, without a password")
+	}
+	usr.PasswordHash = ""
+	if len(usr.Password) == 0 {
+		if current, err := s.AclUser(usr.Name); err == nil {
+			usr.PasswordHash = current.PasswordHash
+		}
+	} else {
+		hash, err := bcrypt.GenerateFromPassword([]byte(usr.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		usr.PasswordHash, usr.Password = string(hash), ""
+	}
+	buff, err := json.Marshal(usr)
+	if err != nil {
+		return err
+	}
+	return s.raftApply(&VpLogCmd{Op: CMDACLSET, Key: AclUserKind + usr.Name, Value: buff, Origin: o})
+}
+
+func (s *Server) RaftAclDeleteUser(name string, o *VpOrigin) error {
+	return s.raftApply(&VpLogCmd{Op: CMDACLDEL, Key: AclUserKind + name, Origin: o})
+}
+
+/* ==================================================================================
+                            OpenID Connect
+================================================================================== */
+
+func b64Int(v string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+func (o *Oidc) getJson(u string, out interface{}) error {
+	res, err := o.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s returned %s", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// load fetches the provider configuration and signing keys, at most once per OidcCacheTtl
+// unless forced (e.g. when a token is signed with an unknown key).
+func (o *Oidc) load(force bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !force && time.Since(o.loadedAt) < OidcCacheTtl {
+		return nil
+	}
+	var disc struct {
+		Issuer   string `json:"issuer"`
+		AuthUrl  string `json:"authorization_endpoint"`
+		TokenUrl string `json:"token_endpoint"`
+		JwksUrl  string `json:"jwks_uri"`
+	}
+	if err := o.getJson(o.issuer+"/.well-known/openid-configuration", &disc); err != nil {
+		return err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJson(disc.JwksUrl, &jwks); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err := b64Int(k.N)
+			if err != nil {
+				return err
+			}
+			e, err := b64Int(k.E)
+			if err != nil {
+				return err
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err := b64Int(k.X)
+			if err != nil {
+				return err
+			}
+			y, err := b64Int(k.Y)
+			if err != nil {
+				return err
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		}
+	}
+	o.authUrl, o.tokenUrl, o.jwksUrl, o.keys, o.loadedAt = disc.AuthUrl, disc.TokenUrl, disc.JwksUrl, keys, time.Now()
+	return nil
+}
+
+func (o *Oidc) keyOf(kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	key, ok := o.keys[kid]
+	o.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if err := o.load(true); err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("oidc: unknown signing key [%s]", kid)
+}
+
+// verifyIdToken checks the signature and claims of an ID token and returns the user name.
+func (o *Oidc) verifyIdToken(idToken, nonce string) (string, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("oidc: malformed id token")
+	}
+	enc := base64.RawURLEncoding
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims struct {
+		Iss   string          `json:"iss"`
+		Aud   json.RawMessage `json:"aud"`
+		Exp   int64           `json:"exp"`
+		Nonce string          `json:"nonce"`
+		Sub   string          `json:"sub"`
+		Email string          `json:"email"`
+		// a boolean, or a string for some providers
+		EmailVerified json.RawMessage `json:"email_verified"`
+	}
+	rawHeader, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return "", err
+	}
+	rawClaims, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return "", err
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	key, err := o.keyOf(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return "", fmt.Errorf("oidc: unsupported algorithm [%s]", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return "", err
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return "", fmt.Errorf("oidc: unsupported algorithm [%s]", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return "", errors.New("oidc: invalid id token signature")
+		}
+	}
+	var aud []string
+	if err := json.Unmarshal(claims.Aud, &aud); err != nil {
+		aud = []string{strings.Trim(string(claims.Aud), `"`)}
+	}
+	audOk := false
+	for _, a := range aud {
+		audOk = audOk || a == o.clientId
+	}
+	switch {
+	case strings.TrimSuffix(claims.Iss, "/") != o.issuer:
+		return "", errors.New("oidc: issuer mismatch")
+	case !audOk:
+		return "", errors.New("oidc: audience mismatch")
+	case time.Now().Unix() > claims.Exp:
+		return "", errors.New("oidc: id token expired")
+	case claims.Nonce != nonce:
+		return "", errors.New("oidc: nonce mismatch")
+	}
+	// an unverified email could be anyone's
+	if verified := string(claims.EmailVerified); len(claims.Email) > 0 && (verified == "true" || verified == `"true"`) {
+		return claims.Email, nil
+	}
+	if len(claims.Sub) == 0 {
+		return "", errors.New("oidc: id token without subject")
+	}
+	return claims.Sub, nil
+}
+
+func (o *Oidc) exchange(code string) (string, error) {
+	form := url.Values{
+		"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {o.redirectUrl},
+		"client_id": {o.clientId}, "client_secret": {o.clientSecret},
+	}
+	res, err := o.client.PostForm(o.tokenUrl, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var tokens struct {
+		IdToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK || len(tokens.IdToken) == 0 {
+		return "", fmt.Errorf("oidc: token exchange failed: %s %s", res.Status, tokens.Error)
+	}
+	return tokens.IdToken, nil
+}
+
+/* ==================================================================================
+                            Request methods
+================================================================================== */
+
+func (h *WebHandler) WhoamiRequest(w http.ResponseWriter, req *http.Request) {
+	who := VpWhoami{Secure: h.s.AclEnabled()}
+	if h.s.AclEnabled() {
+		who.Oidc = h.s.sessions.oidc != nil
+		p, err := h.s.PrincipalOfRequest(req)
+		if err != nil {
+			onSuccess(w, &VpResponse{Data: who, Error: err.Error()}, http.StatusUnauthorized)
+			return
+		}
+		if p.Name != AclAnonymous {
+			who.Name = p.Name
+		}
+	}
+	onSuccess(w, &VpResponse{Data: who}, http.StatusOK)
+}
+
+func (h *WebHandler) LoginRequest(w http.ResponseWriter, req *http.Request) {
+	if !h.s.AclEnabled() {
+		onError(w, errors.New("ACLs are disabled"), http.StatusNotFound)
+		return
+	}
+	in := VpUser{}
+	if body, err := bodyOf(w, req); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else if err := json.Unmarshal(body, &in); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else if usr, err := h.s.AclUser(in.Name); err != nil || len(usr.PasswordHash) == 0 {
+		onError(w, ErrAclLogin, http.StatusUnauthorized)
+	} else if bcrypt.CompareHashAndPassword([]byte(usr.PasswordHash), []byte(in.Password)) != nil {
+		onError(w, ErrAclLogin, http.StatusUnauthorized)
+	} else {
+		h.s.sessions.setCookie(w, CSession, SessionLocal, usr.Name, h.s.sessions.ttl, http.SameSiteStrictMode)
+		onSuccess(w, &VpResponse{Data: usr.Name}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) LogoutRequest(w http.ResponseWriter, req *http.Request) {
+	clearCookie(w, CSession)
+	onSuccess(w, &VpResponse{Data: nil}, http.StatusOK)
+}
+
+func (h *WebHandler) OidcLoginRequest(w http.ResponseWriter, req *http.Request) {
+	if !h.s.AclEnabled() || h.s.sessions.oidc == nil {
+		onError(w, errors.New("OIDC login is disabled"), http.StatusNotFound)
+		return
+	}
+	o := h.s.sessions.oidc
+	if err := o.load(false); err != nil {
+		onError(w, err, http.StatusBadGateway)
+		return
+	}
+	state, err := randomHex(16)
+	if err != nil {
+		onError(w, err, http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		onError(w, err, http.StatusInternalServerError)
+		return
+	}
+	h.s.sessions.setCookie(w, COidcState, state, nonce, OidcStateTtl, http.SameSiteLaxMode)
+	q := url.Values{
+		"response_type": {"code"}, "client_id": {o.clientId}, "redirect_uri": {o.redirectUrl},
+		"scope": {"openid email profile"}, "state": {state}, "nonce": {nonce},
+	}
+	http.Redirect(w, req, o.authUrl+"?"+q.Encode(), http.StatusFound)
+}
+
+func (h *WebHandler) OidcCallbackRequest(w http.ResponseWriter, req *http.Request) {
+	if !h.s.AclEnabled() || h.s.sessions.oidc == nil {
+		onError(w, errors.New("OIDC login is disabled"), http.StatusNotFound)
+		return
+	}
+	o := h.s.sessions.oidc
+	state, nonce, err := h.s.sessions.readCookie(req, COidcState)
+	clearCookie(w, COidcState)
+	if err != nil || req.FormValue("state") != state {
+		onError(w, errors.New("oidc: login state mismatch"), http.StatusBadRequest)
+		return
+	}
+	idToken, err := o.exchange(req.FormValue("code"))
+	if err != nil {
+		onError(w, err, http.StatusBadGateway)
+		return
+	}
+	name, err := o.verifyIdToken(idToken, nonce)
+	if err != nil {
+		onError(w, err, http.StatusUnauthorized)
+		return
+	}
+	log.Info("OIDC login", "user", name)
+	h.s.sessions.setCookie(w, CSession, SessionOidc, name, h.s.sessions.ttl, http.SameSiteStrictMode)
+	http.Redirect(w, req, RUi, http.StatusFound)
+}
+
+func (h *WebHandler) AclUserListRequest(w http.ResponseWriter, req *http.Request) {
+	if users, err := h.s.AclUsers(); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: users}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) AclUserSetRequest(w http.ResponseWriter, req *http.Request) {
+	if h.s.raft.State() != raft.Leader {
+		h.forwardToLeader(w, req)
+		return
+	}
+	usr := VpUser{}
+	if body, err := bodyOf(w, req); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else if err := json.Unmarshal(body, &usr); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else if err := h.s.RaftAclSetUser(&usr, h.originOf(req)); err != nil {
+		onError(w, err, http.StatusBadRequest)
+	} else {
+		onSuccess(w, &VpResponse{Data: usr.Name}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) AclUserDeleteRequest(w http.ResponseWriter, req *http.Request) {
+	if h.s.raft.State() != raft.Leader {
+		h.forwardToLeader(w, req)
+		return
+	}
+	name := req.FormValue(PName)
+	if err := h.s.RaftAclDeleteUser(name, h.originOf(req)); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: name}, http.StatusOK)
+	}
+}
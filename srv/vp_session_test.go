@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionCookies(t *testing.T) {
+	ss := newAclServer(t).sessions
+	exp := time.Now().Add(time.Hour)
+	for _, c := range [][2]string{{SessionLocal, "alice"}, {SessionOidc, "auth0|123"}, {"state", ""}, {"a|b", "c.d|e"}} {
+		a, b, err := ss.readValue(CSession, ss.valueOf(CSession, c[0], c[1], exp))
+		if err != nil || a != c[0] || b != c[1] {
+			t.Errorf("%q: read %q %q, %v", c, a, b, err)
+		}
+	}
+
+	value := ss.valueOf(CSession, SessionLocal, "alice", exp)
+	dot := strings.Index(value, ".")
+	other := NewSessions(&Server{aclMaster: "other"}, time.Hour, false, nil)
+	for name, v := range map[string]string{
+		"payload":       ss.valueOf(CSession, SessionLocal, "admin", exp)[:dot] + value[dot:],
+		"signature":     value[:dot+1] + strings.Repeat("A", len(value)-dot-1),
+		"unsigned":      value[:dot],
+		"expired":       ss.valueOf(CSession, SessionLocal, "alice", time.Now().Add(-time.Second)),
+		"OIDC state":    ss.valueOf(COidcState, SessionLocal, "alice", exp),
+		"other key":     other.valueOf(CSession, SessionLocal, "alice", exp),
+		"empty":         "",
+		"extra section": value + ".x",
+	} {
+		if a, b, err := ss.readValue(CSession, v); err != ErrAclNoSession {
+			t.Errorf("%s: read %q %q, %v", name, a, b, err)
+		}
+	}
+}
+
+func TestSessionSetCookie(t *testing.T) {
+	ss := newAclServer(t).sessions
+	w := httptest.NewRecorder()
+	ss.setCookie(w, COidcState, "state", "nonce", OidcStateTtl, http.SameSiteLaxMode)
+	req := httptest.NewRequest(Get, RAuthOidcBack, nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if state, nonce, err := ss.readCookie(req, COidcState); err != nil || state != "state" || nonce != "nonce" {
+		t.Errorf("read %q %q, %v", state, nonce, err)
+	}
+	if _, _, err := ss.readCookie(req, CSession); err != ErrAclNoSession {
+		t.Errorf("missing session cookie: %v", err)
+	}
+}
+
+// TestSessionPrincipal checks that OIDC names with a "|" resolve to their user, and that an OIDC
+// state cookie doesn't stand for a session.
+func TestSessionPrincipal(t *testing.T) {
+	s := newAclServer(t)
+	buff, err := json.Marshal(&VpUser{Name: OidcUserPrefix + "auth0|123", Policies: []string{"ops"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyCmd(t, s.store, 100, &VpLogCmd{Op: CMDACLSET, Key: AclUserKind + OidcUserPrefix + "auth0|123", Value: buff})
+	exp := time.Now().Add(time.Hour)
+	p, err := s.sessions.PrincipalOf(s.sessions.valueOf(CSession, SessionOidc, "auth0|123", exp))
+	if err != nil || !p.ClusterAllowed(AclWrite) {
+		t.Errorf("principal %+v, %v, want the ops policy", p, err)
+	}
+	if p, err := s.sessions.PrincipalOf(s.sessions.valueOf(COidcState, SessionOidc, "auth0|123", exp)); err != ErrAclNoSession {
+		t.Errorf("OIDC state accepted as a session: %+v, %v", p, err)
+	}
+}
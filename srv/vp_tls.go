@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	TlsReloadInterval = 10 * time.Second
+)
+
+/*
+	TlsStore holds this node's certificate and the cluster CA. Files are checked for
+	changes at most every TlsReloadInterval and reloaded in place, so that rotated
+	certificates are picked up by new connections without restarting the node.
+	Peers must present a certificate signed by the CA which is valid for the host
+	part of their peer ID: the host they are dialed on, or for incoming connections
+	the host of one of the servers of the cluster, as listed by peerHosts.
+	Without a CA file, peer certificates are verified against the system roots.
+*/
+type TlsStore struct {
+	certFile, keyFile, caFile string
+	peerHosts                 func() []string // empty while any peer signed by the CA is accepted
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes []time.Time
+	checked  time.Time
+}
+
+func NewTlsStore(certFile, keyFile, caFile string) (*TlsStore, error) {
+	t := &TlsStore{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TlsStore) modTimesOf() ([]time.Time, error) {
+	var times []time.Time
+	for _, f := range []string{t.certFile, t.keyFile, t.caFile} {
+		if len(f) == 0 {
+			times = append(times, time.Time{})
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, fi.ModTime())
+	}
+	return times, nil
+}
+
+func (t *TlsStore) load() error {
+	times, err := t.modTimesOf()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if len(t.caFile) > 0 {
+		caPem, err := ioutil.ReadFile(t.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return fmt.Errorf("no CA certificates found in [%s]", t.caFile)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cert, t.pool, t.modTimes, t.checked = &cert, pool, times, time.Now()
+	return nil
+}
+
+func (t *TlsStore) changed() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if time.Since(t.checked) < TlsReloadInterval {
+		return false
+	}
+	times, err := t.modTimesOf()
+	if err != nil {
+		log.Warn("tls: failed to check certificates", "error", err)
+		return false
+	}
+	for i := range times {
+		if !times[i].Equal(t.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the node certificate and CA pool, reloading them if the files changed.
+func (t *TlsStore) current() (*tls.Certificate, *x509.CertPool) {
+	if t.changed() {
+		if err := t.load(); err != nil {
+			log.Error("tls: failed to reload certificates, keeping previous ones", "error", err)
+		} else {
+			log.Info("tls: certificates reloaded", "cert", t.certFile, "ca", t.caFile)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.checked = time.Now()
+	return t.cert, t.pool
+}
+
+// verifyChain checks a peer certificate chain against the CA, and its identity against one of hosts.
+func (t *TlsStore) verifyChain(certs []*x509.Certificate, hosts []string) error {
+	if len(certs) == 0 {
+		return errors.New("tls: peer presented no certificate")
+	}
+	_, pool := t.current()
+	opts := x509.VerifyOptions{
+		Roots: pool, Intermediates: x509.NewCertPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return err
+	}
+	if len(hosts) == 0 { // not part of a cluster yet
+		return nil
+	}
+	for _, host := range hosts {
+		if certs[0].VerifyHostname(host) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("tls: peer certificate does not match the identity of [%s]", strings.Join(hosts, ", "))
+}
+
+func (t *TlsStore) verifyPeer(hostsOf func() []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		return t.verifyChain(certs, hostsOf())
+	}
+}
+
+// memberHosts lists the hosts incoming raft connections may be authenticated as.
+func (t *TlsStore) memberHosts() []string {
+	if t.peerHosts == nil {
+		return nil
+	}
+	return t.peerHosts()
+}
+
+/*
+	ServerConfig requires connecting peers to present a certificate valid for the host of one of
+	the servers of the cluster, whatever address they connect from. A node which is not part of
+	a configuration yet only knows its boot peers, see peerHosts.
+*/
+func (t *TlsStore) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := t.current()
+			return cert, nil
+		},
+		VerifyPeerCertificate: t.verifyPeer(t.memberHosts),
+	}
+}
+
+// ClientConfig presents this node's certificate and expects one valid for host in return.
+func (t *TlsStore) ClientConfig(host string) *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // chain and host are checked by verifyPeer against the reloadable CA
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := t.current()
+			return cert, nil
+		},
+		VerifyPeerCertificate: t.verifyPeer(func() []string { return []string{host} }),
+	}
+}
+
+// HttpsConfig serves this node's certificate to HTTP clients. Client certificates
+// are verified against the CA according to clientAuth.
+func (t *TlsStore) HttpsConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	getCert := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, _ := t.current()
+		return cert, nil
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCert,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, pool := t.current()
+			return &tls.Config{
+				MinVersion: tls.VersionTLS12, GetCertificate: getCert,
+				ClientAuth: clientAuth, ClientCAs: pool,
+			}, nil
+		},
+	}
+}
+
+// HttpTransport is used for node to node HTTPS requests. The node's certificate is
+// presented to peers that ask for one, and peers must present one valid for their host.
+func (t *TlsStore) HttpTransport() *http.Transport {
+	return &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			dialer := &tls.Dialer{Config: t.ClientConfig(host)}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+/*
+	peerAddr advertises the raft address of the peer ID as is, rather than resolved, so that
+	followers dial a leader named by its host on that host, and verify its certificate for it.
+*/
+type peerAddr string
+
+func (a peerAddr) Network() string {
+	return "tcp"
+}
+
+func (a peerAddr) String() string {
+	return string(a)
+}
+
+// TlsStreamLayer is a raft.StreamLayer with mutually authenticated TLS connections.
+type TlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	tls       *TlsStore
+}
+
+func NewTlsStreamLayer(bind string, advertise net.Addr, t *TlsStore) (*TlsStreamLayer, error) {
+	ln, err := tls.Listen("tcp", bind, t.ServerConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &TlsStreamLayer{Listener: ln, advertise: advertise, tls: t}, nil
+}
+
+func (l *TlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(string(address))
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", string(address), l.tls.ClientConfig(host))
+}
+
+func (l *TlsStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
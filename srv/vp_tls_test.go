@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// testPki issues certificates signed by a CA of its own, written as PEM files to a temporary directory.
+type testPki struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caFile string
+	serial int64
+}
+
+func newTestPki(t *testing.T) *testPki {
+	p := &testPki{dir: t.TempDir()}
+	p.ca, p.caKey = p.create(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "test CA"}, IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	p.caFile = p.write(t, "ca.pem", "CERTIFICATE", p.ca.Raw)
+	return p
+}
+
+func (p *testPki) create(t *testing.T, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.serial++
+	tmpl.SerialNumber = big.NewInt(p.serial)
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func (p *testPki) write(t *testing.T, name, kind string, der []byte) string {
+	file := filepath.Join(p.dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// issue creates a certificate for hosts, names or IPs, and returns its store verifying peers against ca.
+func (p *testPki) issue(t *testing.T, name string, ca *testPki, hosts ...string) *TlsStore {
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	cert, key := p.create(t, tmpl, p.ca, p.caKey)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewTlsStore(p.write(t, name+".pem", "CERTIFICATE", cert.Raw), p.write(t, name+"-key.pem", "EC PRIVATE KEY", der), ca.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestVerifyChain(t *testing.T) {
+	pki, rogue := newTestPki(t), newTestPki(t)
+	store := pki.issue(t, "node", pki, "localhost")
+	for _, c := range []struct {
+		name  string
+		cert  *TlsStore
+		hosts []string
+		ok    bool
+	}{
+		{"signed by the CA", pki.issue(t, "a", pki, "a.cluster"), []string{"a.cluster"}, true},
+		{"one of the hosts", pki.issue(t, "b", pki, "b.cluster"), []string{"a.cluster", "b.cluster"}, true},
+		{"IP SAN", pki.issue(t, "ip", pki, "10.0.0.1"), []string{"10.0.0.1"}, true},
+		{"other host", pki.issue(t, "c", pki, "c.cluster"), []string{"a.cluster", "b.cluster"}, false},
+		{"other CA", rogue.issue(t, "a", pki, "a.cluster"), []string{"a.cluster"}, false},
+		{"other CA, any host", rogue.issue(t, "a", pki, "a.cluster"), nil, false},
+		{"any host of the CA", pki.issue(t, "d", pki, "d.cluster"), nil, true},
+	} {
+		cert, _ := c.cert.current()
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.verifyChain([]*x509.Certificate{leaf}, c.hosts); (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+	if err := store.verifyChain(nil, nil); err == nil {
+		t.Error("peer without certificate accepted")
+	}
+}
+
+// handshake connects client to a stream layer authenticating peers as hosts, and returns the
+// errors of both ends.
+func handshake(t *testing.T, server, client *TlsStore, hosts []string, dialHost string) (error, error) {
+	server.peerHosts = func() []string { return hosts }
+	layer, err := NewTlsStreamLayer("127.0.0.1:0", nil, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layer.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := layer.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		accepted <- err
+	}()
+	_, port, _ := net.SplitHostPort(layer.Listener.Addr().String())
+	dialer := &TlsStreamLayer{tls: client}
+	conn, err := dialer.Dial(raft.ServerAddress(net.JoinHostPort(dialHost, port)), 5*time.Second)
+	if err != nil {
+		layer.Close()
+		return <-accepted, err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte{1})
+	return <-accepted, err
+}
+
+func TestTlsStreamLayer(t *testing.T) {
+	pki, rogue := newTestPki(t), newTestPki(t)
+	server := pki.issue(t, "server", pki, "localhost")
+	for _, c := range []struct {
+		name               string
+		client             *TlsStore
+		hosts              []string
+		dialHost           string
+		serverOk, clientOk bool
+	}{
+		{"peer of the cluster", pki.issue(t, "peer", pki, "peer.cluster"), []string{"peer.cluster"}, "localhost", true, true},
+		{"peer of a new node", pki.issue(t, "peer", pki, "peer.cluster"), nil, "localhost", true, true},
+		{"unknown peer", pki.issue(t, "other", pki, "other.cluster"), []string{"peer.cluster"}, "localhost", false, true},
+		{"peer of another CA", rogue.issue(t, "peer", pki, "peer.cluster"), nil, "localhost", false, true},
+		{"server dialed on another host", pki.issue(t, "peer", pki, "peer.cluster"), []string{"peer.cluster"}, "127.0.0.1", false, false},
+		{"server of another CA", pki.issue(t, "peer", rogue, "peer.cluster"), []string{"peer.cluster"}, "localhost", false, false},
+	} {
+		serverErr, clientErr := handshake(t, server, c.client, c.hosts, c.dialHost)
+		if (serverErr == nil) != c.serverOk || (clientErr == nil) != c.clientOk {
+			t.Errorf("%s: server %v, client %v", c.name, serverErr, clientErr)
+		}
+	}
+}
+
+func TestPeerAddr(t *testing.T) {
+	store := newTestPki(t)
+	layer, err := NewTlsStreamLayer("127.0.0.1:0", peerAddr("localhost:9090"), store.issue(t, "node", store, "localhost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layer.Close()
+	if addr := layer.Addr(); addr.Network() != "tcp" || addr.String() != "localhost:9090" {
+		t.Errorf("advertised %s %s, want the peer ID's address unresolved", addr.Network(), addr)
+	}
+}
+
+func TestPeerHosts(t *testing.T) {
+	s := NewServer("", "a:9090:8080", []string{""}, true)
+	if hosts := s.peerHosts(); hosts != nil {
+		t.Errorf("hosts %v without boot peers, any peer of the CA must be accepted", hosts)
+	}
+	s = NewServer("", "a:9090:8080", []string{"b:9090:8080"}, true)
+	if hosts := s.peerHosts(); len(hosts) != 2 {
+		t.Errorf("hosts %v, want the boot peers", hosts)
+	}
+}
+
+// TestHttpsForwarding checks that nodes serving HTTPS forward writes and query each other over HTTPS,
+// with their certificates, and that clients must present one.
+func TestHttpsForwarding(t *testing.T) {
+	pki := newTestPki(t)
+	nodes, _ := newTestWebCluster(t, 2, pki)
+	leader, follower := nodes[0], nodes[1]
+	url := follower.peerHttp(follower.peerId) + RV1Kv + "a"
+	if !strings.HasPrefix(url, "https://") {
+		t.Fatalf("follower served at %s", url)
+	}
+	put := func(client *http.Client) (*http.Response, error) {
+		req, err := http.NewRequest(Put, url, strings.NewReader("b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.Do(req)
+	}
+	res, err := put(&http.Client{Transport: pki.issue(t, "client", pki).HttpTransport()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get(HLeader) != leader.peerId {
+		t.Errorf("%d from %s", res.StatusCode, res.Header.Get(HLeader))
+	}
+	if v := valueOf(t, leader.store, "a"); v != "b" {
+		t.Errorf("value %q on the leader", v)
+	}
+	members, err := leader.RaftMembers()
+	if err != nil || len(members) != 2 || members[1].Error != "" || members[1].LastLogIndex == 0 {
+		t.Errorf("members %+v, %v", members, err)
+	}
+	if res, err := put(&http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}); err == nil {
+		res.Body.Close()
+		t.Errorf("client without a certificate answered %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	HTraceParent       = "traceparent"
+	OtlpTracesPath     = "/v1/traces"
+	TraceBatchSize     = 512
+	TraceQueueSize     = 4096
+	TraceFlushPeriod   = 5 * time.Second
+	TraceExportTimeout = 10 * time.Second
+)
+
+type SpanKind = trace.SpanKind
+
+const (
+	SpanInternal = trace.SpanKindInternal
+	SpanServer   = trace.SpanKindServer
+	SpanClient   = trace.SpanKindClient
+)
+
+/*
+	Span is one timed operation of a trace. Spans are only recorded while a Tracer is
+	installed; otherwise StartSpan returns nil, and every Span method accepts a nil receiver,
+	so that instrumented code does not have to check whether tracing is enabled.
+*/
+type Span struct {
+	span trace.Span
+}
+
+/*
+	Tracer exports finished spans in batches to an OpenTelemetry collector, with the OTLP/HTTP
+	exporter of the OpenTelemetry SDK. Root spans are sampled with the given ratio, other spans
+	follow their parent. Spans are dropped when the export queue is full.
+*/
+type Tracer struct {
+	node     string
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// tracer is the installed Tracer, nil when tracing is disabled.
+var tracer *Tracer
+
+// propagator reads and writes W3C trace context, in HTTP headers and raft log entries.
+var propagator = propagation.TraceContext{}
+
+func NewTracer(endpoint string, node string, ratio float64) (*Tracer, error) {
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+OtlpTracesPath),
+		otlptracehttp.WithTimeout(TraceExportTimeout))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxExportBatchSize(TraceBatchSize), sdktrace.WithMaxQueueSize(TraceQueueSize),
+			sdktrace.WithBatchTimeout(TraceFlushPeriod), sdktrace.WithExportTimeout(TraceExportTimeout)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "vephar"), attribute.String("service.instance.id", node),
+			attribute.String("service.version", version),
+		)),
+	)
+	return &Tracer{node: node, provider: provider, tracer: provider.Tracer("vephar")}, nil
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+func attrOf(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case uint16:
+		return attribute.Int(key, int(v))
+	case uint64:
+		return attribute.Int64(key, int64(v))
+	case float64:
+		return attribute.Float64(key, v)
+	}
+	return attribute.String(key, fmt.Sprint(value))
+}
+
+/* ==================================================================================
+                            Spans
+================================================================================== */
+
+func (t *Tracer) start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(kind))
+	return ctx, &Span{span: span}
+}
+
+// StartSpan starts a child of the span in ctx, or a new trace, and returns a context holding it.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	return tracer.start(ctx, name, kind)
+}
+
+// StartRemoteSpan continues a trace from a traceparent value, e.g. of a raft log entry.
+// Without a valid parent, nothing is recorded.
+func StartRemoteSpan(traceParent string, name string, kind SpanKind) *Span {
+	if tracer == nil {
+		return nil
+	}
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier{HTraceParent: traceParent})
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	_, s := tracer.start(ctx, name, kind)
+	return s
+}
+
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s != nil {
+		s.span.SetAttributes(attrOf(key, value))
+	}
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// TraceParent formats the span as a W3C traceparent value, for propagation.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(trace.ContextWithSpan(context.Background(), s.span), carrier)
+	return carrier[HTraceParent]
+}
+
+// Inject adds the span's trace context to the headers of an outgoing request.
+func (s *Span) Inject(h http.Header) {
+	if s != nil {
+		propagator.Inject(trace.ContextWithSpan(context.Background(), s.span), propagation.HeaderCarrier(h))
+	}
+}
+
+func (s *Span) End() {
+	if s != nil {
+		s.span.End()
+	}
+}
+
+/* ==================================================================================
+                            OTLP export
+================================================================================== */
+
+// Start installs the tracer, whose provider exports spans until Stop.
+func (t *Tracer) Start() {
+	tracer = t
+}
+
+// Stop exports the spans still queued.
+func (t *Tracer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), TraceExportTimeout)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		log.Warn("failed to export spans", "error", err)
+	}
+}
+
+/* ==================================================================================
+                            HTTP instrumentation
+================================================================================== */
+
+// Traced records a server span for each request of a route, continuing the client's trace if any.
+func Traced(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if tracer == nil {
+			next(w, req)
+			return
+		}
+		ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.start(ctx, req.Method+" "+route, SpanServer)
+		defer span.End()
+		span.SetAttr("http.method", req.Method)
+		span.SetAttr("http.route", route)
+		span.SetAttr("vephar.node", tracer.node)
+		if id := requestIdOf(req); len(id) > 0 {
+			span.SetAttr("vephar.request_id", id)
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, req.WithContext(ctx))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		span.SetAttr("http.status_code", sw.status)
+		if sw.status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%d %s", sw.status, http.StatusText(sw.status)))
+		}
+	}
+}
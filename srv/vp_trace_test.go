@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// installTestTracer records every span in memory until the end of the test.
+func installTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer = &Tracer{node: testPeerId, provider: provider, tracer: provider.Tracer("vephar")}
+	t.Cleanup(func() { tracer = nil })
+	return exporter
+}
+
+func TestTracingDisabled(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "a", SpanInternal)
+	span.SetAttr("k", 1)
+	span.SetError(errors.New("e"))
+	span.Inject(http.Header{})
+	span.End()
+	if span != nil || ctx != context.Background() || span.TraceParent() != "" {
+		t.Error("span recorded without a tracer")
+	}
+	if StartRemoteSpan("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "b", SpanServer) != nil {
+		t.Error("remote span recorded without a tracer")
+	}
+}
+
+// TestTraced checks that a request continues the client's trace, down to the apply of its log entry.
+func TestTraced(t *testing.T) {
+	exporter := installTestTracer(t)
+	var traceParent string
+	handler := Traced(RKvSet, func(w http.ResponseWriter, req *http.Request) {
+		_, span := StartSpan(req.Context(), "raft.set", SpanInternal)
+		span.SetError(errors.New("failed"))
+		traceParent = span.TraceParent()
+		span.End()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	req := httptest.NewRequest(Get, RKvSet, nil)
+	req.Header.Set(HTraceParent, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	handler(httptest.NewRecorder(), req)
+	StartRemoteSpan(traceParent, "badger.apply", SpanInternal).End()
+	if StartRemoteSpan("invalid", "badger.apply", SpanInternal) != nil {
+		t.Error("span started without a valid parent")
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("%d spans, want 3", len(spans))
+	}
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		byName[s.Name] = s
+		if s.SpanContext.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("%s: trace %s, want the client's", s.Name, s.SpanContext.TraceID())
+		}
+	}
+	server, set, apply := byName["GET "+RKvSet], byName["raft.set"], byName["badger.apply"]
+	if server.Parent.SpanID().String() != "b7ad6b7169203331" || set.Parent.SpanID() != server.SpanContext.SpanID() ||
+		apply.Parent.SpanID() != set.SpanContext.SpanID() {
+		t.Errorf("parents %s %s %s", server.Parent.SpanID(), set.Parent.SpanID(), apply.Parent.SpanID())
+	}
+	if server.Status.Code != codes.Error || set.Status.Code != codes.Error || apply.Status.Code == codes.Error {
+		t.Errorf("status %v %v %v", server.Status, set.Status, apply.Status)
+	}
+}
+
+// TestTracerExport checks that spans reach an OTLP/HTTP collector, at the latest when the tracer stops.
+func TestTracerExport(t *testing.T) {
+	received := make(chan string, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.URL.Path
+	}))
+	defer collector.Close()
+	tr, err := NewTracer(collector.URL+"/", testPeerId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Start()
+	t.Cleanup(func() { tracer = nil })
+	_, span := StartSpan(context.Background(), "a", SpanInternal)
+	span.End()
+	tr.Stop()
+	select {
+	case path := <-received:
+		if path != OtlpTracesPath {
+			t.Errorf("exported to %s", path)
+		}
+	default:
+		t.Error("nothing exported")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/raft"
 )
@@ -16,6 +17,7 @@ import (
 const (
 	MaxUploadSizeMb    = 8 << 20
 	HContentType       = "Content-Type"
+	HCookie            = "Cookie"
 	VApplicationJson   = "application/json"
 	VMultiPartFormData = "multipart/form-data"
 	VTextPlain         = "text/plain"
@@ -25,11 +27,15 @@ const (
 	PKey               = "key"
 	PValue             = "value"
 	PPeerId            = "peerId"
+	PNonVoter          = "nonVoter"
 	PPrefix            = "prefix"
 	POffset            = "offset"
 	PPageSize          = "pageSize"
 	Get                = "GET"
 	Post               = "POST"
+	Put                = "PUT"
+	Delete             = "DELETE"
+	Head               = "HEAD"
 )
 
 const (
@@ -40,6 +46,12 @@ const (
 	RRfJoin  = "/raft/join"
 	RRfLeave = "/raft/leave"
 	RRfStat  = "/raft/status"
+	RRfXfer  = "/raft/transfer-leadership"
+	RRfProm  = "/raft/promote"
+	RRfDem   = "/raft/demote"
+	RRfAuto  = "/raft/autopilot"
+	RRfMbrs  = "/raft/members"
+	RRfClst  = "/raft/cluster"
 )
 
 type Peer struct {
@@ -52,12 +64,85 @@ type VpResponse struct {
 	Error string
 }
 
+// VpRoute is an API route served by a WebHandler, each of which is described by the OpenAPI document.
+// Routes ending with a slash serve every path under them, see ServePrefix.
+type VpRoute struct {
+	Path    string
+	Handler http.HandlerFunc
+}
+
+/*
+	ServePrefix serves the paths under prefix with handler, and other paths with next. Unlike
+	http.ServeMux, it doesn't redirect requests to their cleaned path, which would change the
+	/v1/kv keys with empty, "." or ".." segments, escaped or not.
+*/
+func ServePrefix(prefix string, handler http.HandlerFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.EscapedPath(), prefix) {
+			handler(w, req)
+		} else {
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
 type WebHandler struct {
-	s *Server
+	s              *Server
+	readyMaxLag    uint64
+	forwardTimeout time.Duration
+	redirectWrites bool // redirect requests for the leader instead of proxying them
+	limiter        *RateLimiter
 }
 
-func NewWebHandler(s *Server) *WebHandler {
-	return &WebHandler{s: s}
+func NewWebHandler(s *Server, readyMaxLag uint64, forwardTimeout time.Duration) *WebHandler {
+	return &WebHandler{s: s, readyMaxLag: readyMaxLag, forwardTimeout: forwardTimeout}
+}
+
+/*
+	Routes lists the API routes with their access checks. Every route must be listed here, and
+	described in openApiOps, rather than registered on its own: the OpenAPI document is tested
+	against this list.
+*/
+func (h *WebHandler) Routes() []VpRoute {
+	return []VpRoute{
+		{RKvList, h.Guard(keyAccess(PPrefix, AclRead), h.KeysRequest)},
+		{RKvGet, h.Guard(keyAccess(PKey, AclRead), h.GetRequest)},
+		{RKvSet, h.Guard(keyAccess(PKey, AclWrite), h.SetRequest)},
+		{RKvDel, h.Guard(keyAccess(PKey, AclWrite), h.DeleteRequest)},
+		{RV1Kv, h.Guard(v1KeyAccess, h.V1KvRequest)},
+		{RKvBatchGet, h.Guard(bodyAccess, h.BulkGetRequest)},
+		{RKvBatchSet, h.Guard(bodyAccess, h.BulkSetRequest)},
+		{RKvBatchDel, h.Guard(bodyAccess, h.BulkDeleteRequest)},
+		{RRfJoin, h.Guard(clusterAccess(AclAdmin), h.RaftJoinRequest)},
+		{RRfLeave, h.Guard(clusterAccess(AclAdmin), h.RaftLeaveRequest)},
+		{RRfStat, h.Guard(clusterAccess(AclRead), h.RaftStatusRequest)},
+		{RRfMbrs, h.Guard(clusterAccess(AclRead), h.RaftMembersRequest)},
+		{RRfClst, h.Guard(clusterAccess(AclRead), h.ClusterStatusRequest)},
+		{RRfXfer, h.Guard(clusterAccess(AclAdmin), h.RaftTransferRequest)},
+		{RRfProm, h.Guard(clusterAccess(AclAdmin), h.RaftPromoteRequest)},
+		{RRfDem, h.Guard(clusterAccess(AclAdmin), h.RaftDemoteRequest)},
+		{RRfAuto, h.Guard(clusterAccess(AclRead), h.RaftAutopilotRequest)},
+		{RAclPolList, h.Guard(clusterAccess(AclAdmin), h.AclPolicyListRequest)},
+		{RAclPolSet, h.Guard(clusterAccess(AclAdmin), h.AclPolicySetRequest)},
+		{RAclPolDel, h.Guard(clusterAccess(AclAdmin), h.AclPolicyDeleteRequest)},
+		{RAclTokList, h.Guard(clusterAccess(AclAdmin), h.AclTokenListRequest)},
+		{RAclTokNew, h.Guard(clusterAccess(AclAdmin), h.AclTokenCreateRequest)},
+		{RAclTokDel, h.Guard(clusterAccess(AclAdmin), h.AclTokenDeleteRequest)},
+		{RAclUsrList, h.Guard(clusterAccess(AclAdmin), h.AclUserListRequest)},
+		{RAclUsrSet, h.Guard(clusterAccess(AclAdmin), h.AclUserSetRequest)},
+		{RAclUsrDel, h.Guard(clusterAccess(AclAdmin), h.AclUserDeleteRequest)},
+		{RAudit, h.Guard(clusterAccess(AclAdmin), h.AuditRequest)},
+		{RMetrics, h.Guard(clusterAccess(AclRead), h.MetricsRequest)},
+		{RHealthLive, h.LiveRequest},
+		{RHealthReady, h.ReadyRequest},
+		{RHealthLeader, h.LeaderRequest},
+		{RAuthWhoami, h.WhoamiRequest},
+		{RAuthLogin, h.LoginRequest},
+		{RAuthLogout, h.LogoutRequest},
+		{RAuthOidc, h.OidcLoginRequest},
+		{RAuthOidcBack, h.OidcCallbackRequest},
+		{ROpenApi, h.OpenApiRequest},
+	}
 }
 
 /* ==================================================================================
@@ -113,44 +198,6 @@ func bodyOf(w http.ResponseWriter, req *http.Request) ([]byte, error) {
 	}
 }
 
-func onLeaderResponse(w http.ResponseWriter, res *http.Response, err error) {
-	if err != nil {
-		onError(w, err, http.StatusInternalServerError)
-	} else {
-		defer res.Body.Close()
-		w.WriteHeader(res.StatusCode)
-		io.Copy(w, res.Body)
-	}
-}
-
-func (h *WebHandler) forwardToLeader(w http.ResponseWriter, req *http.Request) {
-	var url string
-	configFuture := h.s.raft.GetConfiguration()
-	if err := configFuture.Error(); err != nil {
-		onError(w, err, http.StatusInternalServerError)
-	} else {
-		for _, peer := range configFuture.Configuration().Servers {
-			if peer.Address == h.s.raft.Leader() {
-				peerRaft, httpPort := parsePeer(string(peer.ID))
-				url = fmt.Sprintf("http://%s:%s", strings.Split(peerRaft, ":")[0], httpPort) // TODO this may need to be customized
-			}
-		}
-		if len(url) == 0 {
-			onError(w, errors.New("leader not found"), http.StatusBadGateway)
-		}
-		url = url + req.RequestURI
-		log.Info("forwarding request", "from", h.s.peerId, "to", url)
-		switch req.Method {
-		case Get:
-			res, err := http.Get(url)
-			onLeaderResponse(w, res, err)
-		case Post:
-			res, err := http.Post(url, req.Header.Get(HContentType), req.Body)
-			onLeaderResponse(w, res, err)
-		}
-	}
-}
-
 /* ==================================================================================
                             Request methods
 ================================================================================== */
@@ -172,7 +219,12 @@ func (h *WebHandler) KeysRequest(w http.ResponseWriter, req *http.Request) {
 	} else {
 		ps = i
 	}
-	if keys, err := h.s.store.KeysOf([]byte(prefix), []byte(offset), uint16(ps)); err != nil {
+	visible, err := h.keysVisible(req)
+	if err != nil {
+		onError(w, err, http.StatusForbidden)
+		return
+	}
+	if keys, err := h.s.store.KeysOf([]byte(prefix), []byte(offset), uint16(ps), visible); err != nil {
 		onError(w, err, http.StatusInternalServerError)
 	} else {
 		onSuccess(w, &VpResponse{Data: keys}, http.StatusOK)
@@ -193,63 +245,140 @@ func (h *WebHandler) GetRequest(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// leaderOnly tells whether a write received by a follower must be forwarded or redirected
+// at the HTTP level, rather than submitted to the leader over RPC.
+func (h *WebHandler) leaderOnly() bool {
+	return h.s.raft.State() != raft.Leader && (h.s.rpc == nil || h.redirectWrites)
+}
+
 func (h *WebHandler) SetRequest(w http.ResponseWriter, req *http.Request) {
-	if h.s.raft.State() != raft.Leader {
+	if h.leaderOnly() {
 		h.forwardToLeader(w, req)
+	} else if !h.admit(w, req, 1) {
+		return
+	} else if wr, ctx, cancel, err := h.writeOf(req); err != nil {
+		onError(w, err, http.StatusBadRequest)
 	} else {
+		defer cancel()
 		req.ParseForm()
 		key := req.Form.Get(PKey)
 		switch req.Method {
 		case Get:
 			value := req.Form.Get(PValue)
-			if err := h.s.RaftSet(key, []byte(value)); err != nil {
-				onError(w, err, http.StatusInternalServerError)
+			if err := h.s.RaftSet(ctx, key, []byte(value), wr, h.originOf(req)); err != nil {
+				onWriteError(w, err)
 			} else {
-				onSuccess(w, &VpResponse{Data: key}, http.StatusOK)
+				onWritten(w, req, wr, key)
 			}
 		case Post:
 			if value, err := bodyOf(w, req); err != nil {
 				onError(w, err, http.StatusBadRequest)
+			} else if err := h.s.RaftSet(ctx, key, value, wr, h.originOf(req)); err != nil {
+				onWriteError(w, err)
 			} else {
-				h.s.RaftSet(key, value)
-				onSuccess(w, &VpResponse{Data: key}, http.StatusOK)
+				onWritten(w, req, wr, key)
 			}
 		}
 	}
 }
 
 func (h *WebHandler) DeleteRequest(w http.ResponseWriter, req *http.Request) {
-	if h.s.raft.State() != raft.Leader {
+	if h.leaderOnly() {
 		h.forwardToLeader(w, req)
+	} else if !h.admit(w, req, 1) {
+		return
+	} else if wr, ctx, cancel, err := h.writeOf(req); err != nil {
+		onError(w, err, http.StatusBadRequest)
 	} else {
+		defer cancel()
 		req.ParseForm()
 		key := req.Form.Get(PKey)
-		if err := h.s.RaftDelete(key); err != nil {
-			onError(w, err, http.StatusInternalServerError)
+		if err := h.s.RaftDelete(ctx, key, wr, h.originOf(req)); err != nil {
+			onWriteError(w, err)
 		} else {
-			onSuccess(w, &VpResponse{Data: key}, http.StatusOK)
+			onWritten(w, req, wr, key)
 		}
 	}
 }
 
 func (h *WebHandler) RaftStatusRequest(w http.ResponseWriter, r *http.Request) {
-	onSuccess(w, &VpResponse{Data: h.s.raft.Stats()}, http.StatusOK)
+	onSuccess(w, &VpResponse{Data: h.s.RaftStats()}, http.StatusOK)
+}
+
+func (h *WebHandler) RaftMembersRequest(w http.ResponseWriter, r *http.Request) {
+	if members, err := h.s.RaftMembers(); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: members}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) ClusterStatusRequest(w http.ResponseWriter, r *http.Request) {
+	if nodes, err := h.s.ClusterStatus(); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: nodes}, http.StatusOK)
+	}
 }
 
 func (h *WebHandler) RaftJoinRequest(w http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
-	if err := h.s.RaftJoin(req.FormValue(PPeerId)); err != nil {
+	nonVoter, _ := strconv.ParseBool(req.FormValue(PNonVoter))
+	if err := h.s.RaftJoin(req.FormValue(PPeerId), nonVoter, h.originOf(req)); err != nil {
 		onError(w, err, http.StatusInternalServerError)
 	} else {
-		onSuccess(w, &VpResponse{Data: h.s.raft.Stats()}, http.StatusCreated)
+		onSuccess(w, &VpResponse{Data: h.s.RaftStats()}, http.StatusCreated)
 	}
 }
 
 func (h *WebHandler) RaftLeaveRequest(w http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
-	if err := h.s.RaftLeave(req.FormValue(PPeerId)); err != nil {
+	if err := h.s.RaftLeave(req.FormValue(PPeerId), h.originOf(req)); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: h.s.RaftStats()}, http.StatusGone)
+	}
+}
+
+func (h *WebHandler) RaftTransferRequest(w http.ResponseWriter, req *http.Request) {
+	if h.s.raft.State() != raft.Leader {
+		h.forwardToLeader(w, req)
+	} else {
+		req.ParseForm()
+		if err := h.s.RaftTransferLeadership(req.FormValue(PPeerId)); err != nil {
+			onError(w, err, http.StatusInternalServerError)
+		} else {
+			onSuccess(w, &VpResponse{Data: h.s.RaftStats()}, http.StatusOK)
+		}
+	}
+}
+
+func (h *WebHandler) RaftPromoteRequest(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	if err := h.s.RaftPromote(req.FormValue(PPeerId), h.originOf(req)); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: h.s.RaftStats()}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) RaftDemoteRequest(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	if err := h.s.RaftDemote(req.FormValue(PPeerId), h.originOf(req)); err != nil {
+		onError(w, err, http.StatusInternalServerError)
+	} else {
+		onSuccess(w, &VpResponse{Data: h.s.RaftStats()}, http.StatusOK)
+	}
+}
+
+func (h *WebHandler) RaftAutopilotRequest(w http.ResponseWriter, req *http.Request) {
+	if h.s.autopilot == nil {
+		onError(w, errors.New("autopilot disabled"), http.StatusNotImplemented)
+	} else if h.s.raft.State() != raft.Leader {
+		h.forwardToLeader(w, req)
+	} else if health, err := h.s.autopilot.Health(); err != nil {
 		onError(w, err, http.StatusInternalServerError)
 	} else {
-		onSuccess(w, &VpResponse{Data: h.s.raft.Stats()}, http.StatusGone)
+		onSuccess(w, &VpResponse{Data: health}, http.StatusOK)
 	}
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	PTimeout            = "timeout"
+	PAsync              = "async"
+	HIndex              = "X-Vephar-Index"
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+var (
+	ErrWriteTimeout = errors.New("timed out waiting for the write to be applied")
+)
+
+// VpWrite holds the options of a write request, and the index of its log entry once submitted.
+type VpWrite struct {
+	Id    string // idempotency key
+	Async bool   // only wait for the entry to be appended to the leader's log
+	Index uint64
+	Cond  *VpCondition
+	// credentials of the client, authorized again by the leader when submitted over RPC
+	Token, Session string
+}
+
+/*
+	appendWaiters tells leaderAppend when its entry reached the log store. Entries are matched by
+	a nonce which leaderAppend sets as their raft log extensions, passed as is to StoreLogs. The
+	extensions are replicated, so the nonce holds the peer ID of the node and random bytes: entries
+	appended by other leaders, stored by this node as a follower, never match.
+*/
+type appendWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]chan uint64
+}
+
+/* ==================================================================================
+                            Utility functions
+================================================================================== */
+
+/*
+	writeOf reads the idempotency key and the timeout and async query parameters of a write
+	request. The returned context ends with the request, or after the requested timeout, which
+	is bounded by writeMax and defaults to writeWait.
+*/
+func (h *WebHandler) writeOf(req *http.Request) (*VpWrite, context.Context, context.CancelFunc, error) {
+	id, err := idempotencyKeyOf(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	wr := &VpWrite{Id: id, Token: tokenOf(req)}
+	if c, err := req.Cookie(CSession); err == nil && len(wr.Token) == 0 {
+		wr.Session = c.Value
+	}
+	query := req.URL.Query() // not the form, which may be the body of the request
+	if async := query.Get(PAsync); len(async) > 0 {
+		if wr.Async, err = strconv.ParseBool(async); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	timeout := h.s.writeWait
+	if t := query.Get(PTimeout); len(t) > 0 {
+		if timeout, err = time.ParseDuration(t); err != nil {
+			return nil, nil, nil, err
+		} else if timeout <= 0 {
+			return nil, nil, nil, errors.New("timeout must be positive")
+		}
+	}
+	if timeout > h.s.writeMax {
+		timeout = h.s.writeMax
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return wr, ctx, cancel, nil
+}
+
+// writeStatusOf maps the errors of a write, including those returned by the leader over RPC.
+func writeStatusOf(err error) int {
+	switch err.Error() {
+	case ErrIdempotencyKeyReused.Error():
+		return http.StatusUnprocessableEntity
+	case ErrPreconditionFailed.Error():
+		return http.StatusPreconditionFailed
+	case ErrTxnTooLarge.Error():
+		return http.StatusRequestEntityTooLarge
+	case ErrAclDenied.Error(), ErrAclNoToken.Error(), ErrAclNoSession.Error():
+		return http.StatusForbidden
+	case ErrOverloaded.Error(), ErrRateLimited.Error():
+		return http.StatusTooManyRequests
+	case ErrWriteTimeout.Error(), context.DeadlineExceeded.Error(), raft.ErrEnqueueTimeout.Error():
+		return http.StatusGatewayTimeout
+	case context.Canceled.Error():
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// onWritten answers a write with its log index, and 202 Accepted if it was not applied yet.
+func onWritten(w http.ResponseWriter, req *http.Request, wr *VpWrite, data interface{}) {
+	setReplayed(w, req)
+	if wr.Index > 0 {
+		w.Header().Set(HIndex, strconv.FormatUint(wr.Index, 10))
+	}
+	status := http.StatusOK
+	if wr.Async {
+		status = http.StatusAccepted
+	}
+	onSuccess(w, &VpResponse{Data: data}, status)
+}
+
+// waitApplied waits for a log entry to be applied, for at most timeout or until ctx is done.
+// The entry may still be applied afterwards.
+func waitApplied(ctx context.Context, future raft.ApplyFuture, timeout time.Duration) (uint64, *VpRpcResponse, error) {
+	done := make(chan error, 1)
+	go func() { done <- future.Error() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return 0, nil, err
+		}
+		res, _ := future.Response().(*VpRpcResponse)
+		return future.Index(), res, nil
+	case <-timer.C:
+		return 0, nil, ErrWriteTimeout
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+/* ==================================================================================
+                            Asynchronous writes
+================================================================================== */
+
+// awaitAppend registers a log entry to be appended by node, and returns the nonce to append it with.
+func (b *BadgerStore) awaitAppend(node string) (string, chan uint64, error) {
+	random, err := randomHex(12)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := node + "/" + random
+	b.appends.mu.Lock()
+	defer b.appends.mu.Unlock()
+	if b.appends.waiters == nil {
+		b.appends.waiters = make(map[string]chan uint64)
+	}
+	appended := make(chan uint64, 1)
+	b.appends.waiters[nonce] = appended
+	return nonce, appended, nil
+}
+
+func (b *BadgerStore) cancelAppend(nonce string) {
+	b.appends.mu.Lock()
+	defer b.appends.mu.Unlock()
+	delete(b.appends.waiters, nonce)
+}
+
+// notifyAppended is called once logs are stored, and tells their index to leaderAppend.
+func (b *BadgerStore) notifyAppended(logs []*raft.Log) {
+	b.appends.mu.Lock()
+	defer b.appends.mu.Unlock()
+	if len(b.appends.waiters) == 0 {
+		return
+	}
+	for _, l := range logs {
+		if len(l.Extensions) == 0 {
+			continue
+		}
+		if appended, ok := b.appends.waiters[string(l.Extensions)]; ok {
+			appended <- l.Index
+			delete(b.appends.waiters, string(l.Extensions))
+		}
+	}
+}
+
+/*
+	leaderAppend submits an encoded command and returns its index once it was stored in the
+	leader's log, without waiting for it to be committed or applied. It may still be lost if the
+	leader fails before replicating it.
+*/
+func (s *Server) leaderAppend(ctx context.Context, buff []byte, timeout time.Duration) (uint64, *VpRpcResponse, error) {
+	nonce, appended, err := s.store.awaitAppend(s.peerId)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer s.store.cancelAppend(nonce)
+	future := s.raft.ApplyLog(raft.Log{Data: buff, Extensions: []byte(nonce)}, timeout)
+	done := make(chan error, 1)
+	go func() { done <- future.Error() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case index := <-appended:
+		return index, nil, nil
+	case err := <-done: // failed before being appended, or already applied
+		if err != nil {
+			return 0, nil, err
+		}
+		res, _ := future.Response().(*VpRpcResponse)
+		return future.Index(), res, nil
+	case <-timer.C:
+		return 0, nil, ErrWriteTimeout
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// TestAppendNonce checks that entries appended by another leader, replicated to this node, are not
+// taken for its own, even when both nodes registered as many writes.
+func TestAppendNonce(t *testing.T) {
+	a, b := newTestStore(t), newTestStore(t)
+	nonceA, appendedA, err := a.awaitAppend("a:9090:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonceB, _, err := b.awaitAppend("b:9090:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonceA == nonceB {
+		t.Fatalf("nonces of two nodes collide: %s", nonceA)
+	}
+	// a stores the entry of b as a follower, then its own once leader
+	if err := a.StoreLogs([]*raft.Log{{Index: 1, Extensions: []byte(nonceB)}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case index := <-appendedA:
+		t.Fatalf("entry %d of another leader notified", index)
+	default:
+	}
+	if err := a.StoreLogs([]*raft.Log{{Index: 2, Extensions: []byte(nonceA)}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case index := <-appendedA:
+		if index != 2 {
+			t.Errorf("notified index %d, want 2", index)
+		}
+	default:
+		t.Error("own entry not notified")
+	}
+	a.cancelAppend(nonceA)
+	if len(a.appends.waiters) != 0 {
+		t.Error("waiter left once canceled")
+	}
+}
+
+func TestLeaderAppend(t *testing.T) {
+	store := newTestStore(t)
+	s := &Server{peerId: "test", store: store, raft: newTestLeader(t, store)}
+	buff := encodeCmd(t, &VpLogCmd{Op: CMDSET, Key: "a", Value: []byte("1")})
+	index, _, err := s.leaderAppend(context.Background(), buff, 5*time.Second)
+	if err != nil || index == 0 {
+		t.Fatalf("index %d, error %v", index, err)
+	}
+	if err := s.raft.Barrier(5 * time.Second).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if v := valueOf(t, store, "a"); v != "1" {
+		t.Errorf("value %q once applied", v)
+	}
+}
+
+func TestWriteOf(t *testing.T) {
+	h := NewWebHandler(&Server{writeWait: time.Second, writeMax: 3 * time.Second}, 0, time.Second)
+	for query, want := range map[string]time.Duration{
+		"":                    time.Second,
+		"?timeout=2s":         2 * time.Second,
+		"?timeout=1m":         3 * time.Second,
+		"?timeout=0s":         -1,
+		"?timeout=x":          -1,
+		"?async=true":         time.Second,
+		"?async=x":            -1,
+		"?async=1&timeout=2s": 2 * time.Second,
+	} {
+		wr, ctx, cancel, err := h.writeOf(httptest.NewRequest(Put, RV1Kv+"a"+query, nil))
+		if want < 0 {
+			if err == nil {
+				t.Errorf("%q: no error", query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", query, err)
+			continue
+		}
+		deadline, _ := ctx.Deadline()
+		if left := time.Until(deadline); left > want || left < want-time.Second/2 {
+			t.Errorf("%q: timeout %v, want %v", query, left, want)
+		}
+		if wr.Async != strings.Contains(query, "async") {
+			t.Errorf("%q: async %v", query, wr.Async)
+		}
+		cancel()
+	}
+}
+
+// TestWriteModes checks the answers to asynchronous writes, and to writes which time out or whose client leaves.
+func TestWriteModes(t *testing.T) {
+	store := newTestStore(t)
+	s := &Server{peerId: testPeerId, store: store, raft: newTestLeader(t, store), writeWait: time.Second, writeMax: time.Second}
+	h := NewWebHandler(s, 0, time.Second)
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, c := range []struct {
+		name  string
+		req   *http.Request
+		want  int
+		index bool
+	}{
+		{"sync", httptest.NewRequest(Put, RV1Kv+"a", strings.NewReader("1")), http.StatusOK, true},
+		{"async", httptest.NewRequest(Put, RV1Kv+"a?async=true", strings.NewReader("2")), http.StatusAccepted, true},
+		{"timed out", httptest.NewRequest(Put, RV1Kv+"a?timeout=1ns", strings.NewReader("3")), http.StatusGatewayTimeout, false},
+		{"client gone", httptest.NewRequest(Put, RV1Kv+"a", strings.NewReader("4")).WithContext(gone), http.StatusServiceUnavailable, false},
+	} {
+		w := httptest.NewRecorder()
+		h.V1KvRequest(w, c.req)
+		if w.Code != c.want || (w.Header().Get(HIndex) != "") != c.index {
+			t.Errorf("%s: %d at index %q, want %d", c.name, w.Code, w.Header().Get(HIndex), c.want)
+		}
+	}
+	if err := s.raft.Barrier(5 * time.Second).Error(); err != nil {
+		t.Fatal(err)
+	}
+	// the write whose client left was submitted and may still be applied, unlike the timed out one
+	if v := valueOf(t, store, "a"); v != "4" {
+		t.Errorf("value %q, want the last write submitted", v)
+	}
+}
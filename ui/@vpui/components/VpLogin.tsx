@@ -0,0 +1,58 @@
+import * as React from "preact/compat"
+
+interface VlgProps {
+  oidc: boolean
+  error?: string
+  onLogin: (name: string, password: string) => void
+}
+
+interface VlgState {
+  name: string
+  password: string
+}
+
+export default class VpLogin extends React.Component<VlgProps, VlgState> {
+
+  public state: VlgState = {name: "", password: ""}
+
+  public onSubmit(e: any) {
+    e.preventDefault()
+    this.props.onLogin(this.state.name, this.state.password)
+  }
+
+  public render() {
+    const {name, password} = this.state
+    return (
+      <div class="row justify-center">
+        <div class="col xs-12 sm-8 md-6 lg-4">
+          <h2>Login</h2>
+          <div class="box">
+            <form onSubmit={e => this.onSubmit(e)}>
+              <div class="form-group">
+                <label class="form-label">User</label>
+                <input class="form-control" value={name} autoComplete="username"
+                  onChange={(e: any) => this.setState({name: e.target.value})} />
+              </div>
+              <div class="form-group">
+                <label class="form-label">Password</label>
+                <input class="form-control" type="password" value={password} autoComplete="current-password"
+                  onChange={(e: any) => this.setState({password: e.target.value})} />
+                {this.props.error ? <span class="form-helper">{this.props.error}</span> : []}
+              </div>
+              <div class="txc">
+                <button class="btn primary small" type="submit" disabled={!name || !password}>Login</button>
+                {this.props.oidc ? (
+                  <span>
+                    &nbsp;
+                    <a class="btn secondary small" href="/auth/oidc/login">Single sign-on</a>
+                  </span>
+                ) : []}
+              </div>
+            </form>
+          </div>
+        </div>
+      </div>
+    )
+  }
+
+}
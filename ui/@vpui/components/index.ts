@@ -2,7 +2,8 @@ import VpUiLock from "./VpUiLock"
 import VpLogo from "./VpLogo"
 import VpMenuLeft from "./VpMenuLeft"
 import VpMenuTop from "./VpMenuTop"
+import VpLogin from "./VpLogin"
 
 export {
-  VpUiLock, VpLogo, VpMenuLeft, VpMenuTop
+  VpUiLock, VpLogo, VpMenuLeft, VpMenuTop, VpLogin
 }
@@ -2,7 +2,8 @@ import * as React from "preact/compat"
 
 import { useContext } from "preact/hooks"
 import { hit, lockUi, VpContext, VpStore } from "@vpui/store"
-import { rpcRaftStatus } from "@vpui/rpc"
+import { rpcRaftMembers, rpcRaftStatus } from "@vpui/rpc"
+import { VpMember } from "@vpui/schema"
 import { RenderableProps } from "preact"
 import { VpRoute } from "."
 
@@ -15,6 +16,8 @@ class VpRftStatus extends React.Component<VpRftProps> {
     lockUi(true, d)
     .then(() => rpcRaftStatus())
     .then(res => hit({type: VpRoute.RaftStatus, payload: res.Data}, d))
+    .then(() => rpcRaftMembers())
+    .then(res => hit({type: VpRoute.RaftMembers, payload: res.Data}, d))
     .then(() => lockUi(false, d))
   }
 
@@ -29,8 +32,26 @@ class VpRftStatus extends React.Component<VpRftProps> {
     )
   }
 
+  private renderMember(m: VpMember) {
+    return (
+      <tr>
+        <td>
+          <code>{m.ID}</code>
+        </td>
+        <td>{m.Suffrage}</td>
+        <td>{m.Leader ? "Leader" : ""}</td>
+        <td>
+          <a href={`${m.Http}/ui`}>{m.Http}</a>
+        </td>
+        <td>{m.Error ? m.Error : m.LastLogIndex}</td>
+        <td>{m.Lag}</td>
+      </tr>
+    )
+  }
+
   public render() {
     const rft = this.props.s.state.raftStats
+    const members = this.props.s.state.raftMembers
     return (
       <div>
         <h2>Raft Status</h2>
@@ -50,10 +71,29 @@ class VpRftStatus extends React.Component<VpRftProps> {
               {this.renderKv("Peers", rft.num_peers)}
               {this.renderKv("Protocol version", rft.protocol_version)}
               {this.renderKv("State", rft.state)}
+              {this.renderKv("Suffrage", rft.suffrage)}
               {this.renderKv("Term", rft.term)}
             </tbody>
           </table>
         </div>
+        <h2>Members</h2>
+        <div class="box">
+          <table class="table interactive">
+            <thead>
+              <tr>
+                <th>ID</th>
+                <th>Suffrage</th>
+                <th>Role</th>
+                <th>HTTP</th>
+                <th>Last log index</th>
+                <th>Lag</th>
+              </tr>
+            </thead>
+            <tbody>
+              {members.map(m => this.renderMember(m))}
+            </tbody>
+          </table>
+        </div>
       </div>
     )
   }
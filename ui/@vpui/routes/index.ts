@@ -3,10 +3,14 @@ import VpKvList from "@vpui/routes/VpKvList"
 
 export const enum VpRoute {
   RaftStatus = "/raft/status",
+  RaftMembers = "/raft/members",
   KvList = "/kv/list",
   KvGet = "/kv/get",
   KvSet = "/kv/set",
   KvDel = "/kv/del",
+  AuthWhoami = "/auth/whoami",
+  AuthLogin = "/auth/login",
+  AuthLogout = "/auth/logout",
   Ui = "/ui",
   UiKvList = "/ui/kv/list"
 }
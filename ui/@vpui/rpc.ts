@@ -1,5 +1,5 @@
 import { VpRoute } from "@vpui/routes"
-import { VpKeyPage, VpRaftStats, VpRpcResponse } from "@vpui/schema"
+import { VpKeyPage, VpMember, VpRaftStats, VpRpcResponse, VpWhoami } from "@vpui/schema"
 
 const urlParamsOf = (args: Map<string, string>) => {
   return [...args.entries()]
@@ -26,7 +26,13 @@ export const doJsonIo = <I, O>(url: string, req: I, method: string): Promise<O>
   return doBodyRequest(url, json, {method})
 }
 
+export const rpcWhoami = (): Promise<VpRpcResponse<VpWhoami>> => doJsonIo(VpRoute.AuthWhoami, undefined, "GET")
+export const rpcLogin = (Name: string, Password: string): Promise<VpRpcResponse<string>> =>
+  doJsonIo(VpRoute.AuthLogin, {Name, Password}, "POST")
+export const rpcLogout = (): Promise<VpRpcResponse<any>> => doJsonIo(VpRoute.AuthLogout, undefined, "POST")
+
 export const rpcRaftStatus = (): Promise<VpRpcResponse<VpRaftStats>> => doJsonIo(VpRoute.RaftStatus, undefined, "GET")
+export const rpcRaftMembers = (): Promise<VpRpcResponse<VpMember[]>> => doJsonIo(VpRoute.RaftMembers, undefined, "GET")
 export const rpcKvList = (prefix: string, offset: string, pageSize: Number): Promise<VpRpcResponse<VpKeyPage>> =>
   doJsonIo(buildUrl(VpRoute.KvList, {prefix, offset, pageSize}), undefined, "GET")
 
@@ -18,9 +18,27 @@ export interface VpRaftStats {
 
   num_peers: Number
   state: string
+  suffrage: string
   term: Number
 }
 
+export interface VpMember {
+  ID: string
+  Raft: string
+  Http: string
+  Suffrage: string
+  Leader: boolean
+  LastLogIndex: Number
+  Lag: Number
+  Error: string
+}
+
+export interface VpWhoami {
+  Name: string
+  Oidc: boolean
+  Secure: boolean
+}
+
 export interface VpKeyPage {
 	Keys: string[]
 	NextKey: string
@@ -2,12 +2,14 @@ import * as React from "preact/compat"
 import { Context, createContext } from "preact"
 
 import { VpRoute } from "@vpui/routes"
-import { VpRaftStats } from "@vpui/schema"
+import { VpMember, VpRaftStats, VpWhoami } from "@vpui/schema"
 
 export interface VpState {
   uiLocked: boolean
   lastMessage: any
   raftStats: VpRaftStats
+  raftMembers: VpMember[]
+  whoami: VpWhoami
 }
 
 export type VpDispatch = (action: VpAction) => void
@@ -22,6 +24,8 @@ export type VpAction =
   | {type: "usrMsg", payload: string}
   | {type: "usrMsgClear"}
   | {type: VpRoute.RaftStatus, payload: any}
+  | {type: VpRoute.RaftMembers, payload: any}
+  | {type: VpRoute.AuthWhoami, payload: VpWhoami}
 
 export const hit = (act: VpAction, d: VpDispatch): Promise<void> => {
   d(act)
@@ -42,13 +46,17 @@ export const vpReducer: React.Reducer<VpState, VpAction> = (state0: VpState, act
     case "usrMsgClear": return {...state0, lastMessage: undefined}
     case "lockUi": return {...state0, uiLocked: action.payload}
     case VpRoute.RaftStatus: return {...state0, raftStats: action.payload}
+    case VpRoute.RaftMembers: return {...state0, raftMembers: action.payload}
+    case VpRoute.AuthWhoami: return {...state0, whoami: action.payload}
   }
 }
 
 export const initialState: VpState = {
   lastMessage: undefined,
   uiLocked: false,
-  raftStats: {} as VpRaftStats
+  raftStats: {} as VpRaftStats,
+  raftMembers: [],
+  whoami: undefined
 }
 
 export const VpContext: Context<VpStore> = createContext({
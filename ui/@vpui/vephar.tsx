@@ -7,18 +7,29 @@ import "../res/main.scss"
 
 import * as React from "preact/compat"
 import * as ReactDOM from "preact/compat"
-import { useReducer } from "preact/hooks"
+import { useEffect, useReducer, useState } from "preact/hooks"
 
 import Router from 'preact-router'
 
-import { VpUiLock, VpMenuLeft, VpMenuTop } from "@vpui/components"
+import { VpUiLock, VpMenuLeft, VpMenuTop, VpLogin } from "@vpui/components"
 import { VpKvList, VpRaftStatus, VpRoute } from "@vpui/routes"
-import { initialState, VpContext, vpReducer } from "@vpui/store"
+import { hit, initialState, VpContext, VpDispatch, vpReducer } from "@vpui/store"
+import { rpcLogin, rpcLogout, rpcWhoami } from "@vpui/rpc"
 import { VpVersion } from "@vpui/schema"
 
+const loadWhoami = (d: VpDispatch) => rpcWhoami()
+  .then(res => hit({type: VpRoute.AuthWhoami, payload: res.Data}, d))
+
 class VpShell extends React.Component {
   public render() {
     const [state, dispatch] = useReducer(vpReducer, initialState)
+    const [loginError, setLoginError] = useState<string>(undefined)
+    useEffect(() => { loadWhoami(dispatch) }, [])
+
+    const who = state.whoami
+    const onLogin = (name: string, password: string) => rpcLogin(name, password)
+      .then(res => res.Error ? setLoginError(res.Error) : loadWhoami(dispatch))
+    const onLogout = () => rpcLogout().then(() => loadWhoami(dispatch))
     return (
       <VpContext.Provider value={{state, dispatch}}>
         <VpUiLock>
@@ -32,10 +43,14 @@ class VpShell extends React.Component {
               </div>
               <div class="col xs-12 sm-12 md-11 lg-11 xl-11">
                 <div id="appFrame">
-                  <Router>
-                    <VpRaftStatus path={VpRoute.Ui} />
-                    <VpKvList path={VpRoute.UiKvList} />
-                  </Router>
+                  {!who ? [] : who.Secure && !who.Name ? (
+                    <VpLogin oidc={who.Oidc} error={loginError} onLogin={onLogin} />
+                  ) : (
+                    <Router>
+                      <VpRaftStatus path={VpRoute.Ui} />
+                      <VpKvList path={VpRoute.UiKvList} />
+                    </Router>
+                  )}
                 </div>
               </div>
             </div>
@@ -43,6 +58,9 @@ class VpShell extends React.Component {
               <div class="col auto">
                 <div class="txc version p16">
                   {VpVersion}
+                  {who && who.Name ? (
+                    <span> &middot; {who.Name} &middot; <a href="#" onClick={onLogout}>Logout</a></span>
+                  ) : []}
                 </div>
               </div>
             </div>